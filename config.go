@@ -0,0 +1,233 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ClientConfig holds the settings used by Dial
+type ClientConfig struct {
+	// Account is the bare JID used for authentication (user@domain). With
+	// Domain set, it may be left empty for EXTERNAL, or for ANONYMOUS along
+	// with Password.
+	Account  string
+	Password string
+	// Domain overrides the XMPP domain taken from Account
+	Domain   string
+	Resource string
+
+	// Address overrides DNS resolution ("host:port")
+	Address string
+	// DirectTLS starts TLS right away on Address instead of STARTTLS
+	DirectTLS bool
+	// Resolver finds the server when Address is empty, net.DefaultResolver
+	// when nil
+	Resolver Resolver
+	// TLSConfig is used for STARTTLS, ServerName defaults to the XMPP domain
+	// so that the certificate is verified against it, not the SRV target
+	TLSConfig *tls.Config
+	// TLSPolicy defaults to TLSRequired
+	TLSPolicy TLSPolicy
+	// RootCAs verifies the server certificate, defaults to the system roots
+	RootCAs *x509.CertPool
+	// MinTLSVersion defaults to TLS 1.2
+	MinTLSVersion uint16
+	// PinnedKeys are SHA-256 hashes of SubjectPublicKeyInfo, one of the
+	// certificates of the verified chain must match when set
+	PinnedKeys [][]byte
+	// InsecureSkipVerify accepts any certificate, pins are still checked
+	// against the server certificate alone
+	InsecureSkipVerify bool
+	// KeyLogWriter receives the TLS secrets in NSS key log format, to
+	// decrypt captures with Wireshark. Debugging only, off by default.
+	KeyLogWriter io.Writer
+	// Certificates are presented during the TLS handshake, the server may
+	// then authenticate the account with SASL EXTERNAL
+	Certificates []tls.Certificate
+	// Mechanisms lists the allowed SASL mechanisms by order of preference,
+	// defaults to the strongest supported mechanisms first. Mechanisms are
+	// added with RegisterMechanism.
+	Mechanisms []string
+	// AuthzID is the identity to act as with EXTERNAL, empty for the one
+	// of the certificate
+	AuthzID string
+	// MechanismPolicy may refuse a mechanism for the current TLS session,
+	// PLAIN without TLS is refused anyway
+	MechanismPolicy MechanismPolicy
+	// UserAgent identifies this client with SASL 2
+	UserAgent *UserAgent
+	// Bind2 binds the resource within SASL 2 when the server offers it,
+	// instead of Resource
+	Bind2 *Bind2Config
+	// Fast logs in with a token instead of the password once the server
+	// issued one
+	Fast *FastConfig
+	// Tasks may run after the mechanism when the server asks for them
+	// with SASL 2, the first one offered is used
+	Tasks []Task
+
+	// DialTimeout bounds each TCP connection attempt, 10 seconds by default
+	// so that an unreachable server leaves time to try the next one
+	DialTimeout time.Duration
+	// Timeout bounds the whole negotiation, from stream start to bind
+	Timeout time.Duration
+	// RequestTimeout bounds IQ requests sent without a context deadline,
+	// defaults to 30 seconds
+	RequestTimeout time.Duration
+
+	// Mux receives incoming stanzas, defaults to a new Mux
+	Mux *Mux
+	// InitialPresence is sent once the session is established
+	InitialPresence *Presence
+	// RosterStore keeps the versioned roster, defaults to a memory store
+	RosterStore RosterStore
+	// SubscriptionPolicy answers incoming subscription requests, by default
+	// they are all left to SubscriptionRequests
+	SubscriptionPolicy SubscriptionPolicy
+
+	// Retry makes Dial try again after a Retryable error, nil tries once
+	Retry *RetryPolicy
+
+	// Logger defaults to the logrus standard logger
+	Logger logrus.FieldLogger
+}
+
+// RetryPolicy bounds the attempts of Dial
+type RetryPolicy struct {
+	// Attempts counts the first one, zero retries until the context is done
+	Attempts int
+	// Backoff is the first delay, doubled after every attempt, defaults to
+	// one second
+	Backoff time.Duration
+	// MaxBackoff caps the delay, defaults to one minute
+	MaxBackoff time.Duration
+}
+
+// Delay before the attempt following this one
+func (retry *RetryPolicy) delay(attempt int) time.Duration {
+	delay := retry.Backoff
+	if delay <= 0 {
+		delay = time.Second
+	}
+	max_delay := retry.MaxBackoff
+	if max_delay <= 0 {
+		max_delay = time.Minute
+	}
+	for i := 1; i < attempt && delay < max_delay; i++ {
+		delay *= 2
+	}
+	if delay > max_delay {
+		delay = max_delay
+	}
+	return delay
+}
+
+// Return the XMPP domain of the account
+func (config *ClientConfig) domain() string {
+	if config.Domain != "" {
+		return config.Domain
+	}
+	if i := strings.LastIndex(config.Account, "@"); i >= 0 {
+		return config.Account[i+1:]
+	}
+	return ""
+}
+
+func (config *ClientConfig) logger() logrus.FieldLogger {
+	if config.Logger != nil {
+		return config.Logger
+	}
+	return logrus.StandardLogger()
+}
+
+func (config *ClientConfig) resolver() Resolver {
+	if config.Resolver != nil {
+		return config.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (config *ClientConfig) mux() *Mux {
+	if config.Mux != nil {
+		return config.Mux
+	}
+	return NewMux()
+}
+
+func (config *ClientConfig) rosterStore() RosterStore {
+	if config.RosterStore != nil {
+		return config.RosterStore
+	}
+	return NewMemoryRosterStore()
+}
+
+func (config *ClientConfig) dialTimeout() time.Duration {
+	if config.DialTimeout > 0 {
+		return config.DialTimeout
+	}
+	return 10 * time.Second
+}
+
+func (config *ClientConfig) requestTimeout() time.Duration {
+	if config.RequestTimeout > 0 {
+		return config.RequestTimeout
+	}
+	return 30 * time.Second
+}
+
+func (config *ClientConfig) mechanisms() []string {
+	if len(config.Mechanisms) > 0 {
+		return config.Mechanisms
+	}
+	return defaultMechanisms
+}
+
+func (config *ClientConfig) tlsConfig(domain string) *tls.Config {
+	var conf *tls.Config
+	if config.TLSConfig != nil {
+		conf = config.TLSConfig.Clone()
+	} else {
+		conf = &tls.Config{}
+	}
+	if config.RootCAs != nil {
+		conf.RootCAs = config.RootCAs
+	}
+	if config.MinTLSVersion != 0 {
+		conf.MinVersion = config.MinTLSVersion
+	}
+	if conf.MinVersion == 0 {
+		conf.MinVersion = tls.VersionTLS12
+	}
+	if config.InsecureSkipVerify {
+		conf.InsecureSkipVerify = true
+	}
+	if config.KeyLogWriter != nil {
+		conf.KeyLogWriter = config.KeyLogWriter
+	}
+	if len(config.PinnedKeys) > 0 {
+		verify := conf.VerifyConnection
+		conf.VerifyConnection = func(state tls.ConnectionState) error {
+			if err := verify_pins(state, config.PinnedKeys); err != nil {
+				return err
+			}
+			if verify != nil {
+				return verify(state)
+			}
+			return nil
+		}
+	}
+	if len(config.Certificates) > 0 {
+		certificates := make([]tls.Certificate, 0, len(conf.Certificates)+len(config.Certificates))
+		certificates = append(certificates, conf.Certificates...)
+		conf.Certificates = append(certificates, config.Certificates...)
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = domain
+	}
+	return conf
+}
@@ -0,0 +1,221 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+)
+
+var (
+	ErrClosed      = errors.New("connection closed")
+	ErrNoMechanism = errors.New("no usable SASL mechanism")
+	ErrNoBind      = errors.New("server did not return a JID")
+	// RFC 6121 # 3.4 — the server did not advertise pre-approval
+	ErrPreApprovalUnsupported = errors.New("subscription pre-approval not supported")
+	ErrCertificatePin         = errors.New("no pinned key in the server certificate chain")
+	ErrStartTLSMissing        = errors.New("server did not offer STARTTLS")
+	ErrStartTLSFailed         = errors.New("server failed STARTTLS")
+	// RFC 2782 — the domain publishes a "." SRV target
+	ErrServiceUnavailable = errors.New("XMPP service not available for this domain")
+)
+
+// RFC 6120 # 6.5 — SASL failure conditions, wrapped by AuthError
+var (
+	ErrAccountDisabled      = errors.New("account disabled")
+	ErrCredentialsExpired   = errors.New("credentials expired")
+	ErrMechanismTooWeak     = errors.New("mechanism too weak")
+	ErrNotAuthorized        = errors.New("not authorized")
+	ErrTemporaryAuthFailure = errors.New("temporary authentication failure")
+)
+
+// XEP 0077 # 3.1 — registration error conditions, wrapped by RegisterError
+var (
+	ErrRegistrationConflict      = errors.New("username already registered")
+	ErrRegistrationNotAcceptable = errors.New("registration data not acceptable")
+	ErrRegistrationNotAllowed    = errors.New("registration not allowed")
+	// A field asked by the server was left empty
+	ErrRegistrationIncomplete = errors.New("registration fields not filled")
+)
+
+var registerConditions = map[string]error{
+	"conflict":       ErrRegistrationConflict,
+	"not-acceptable": ErrRegistrationNotAcceptable,
+	"not-allowed":    ErrRegistrationNotAllowed,
+}
+
+var saslConditions = map[string]error{
+	"account-disabled":       ErrAccountDisabled,
+	"credentials-expired":    ErrCredentialsExpired,
+	"mechanism-too-weak":     ErrMechanismTooWeak,
+	"not-authorized":         ErrNotAuthorized,
+	"temporary-auth-failure": ErrTemporaryAuthFailure,
+}
+
+// ResolveError is returned when the XMPP server address can not be found
+type ResolveError struct {
+	Domain string
+	Err    error
+}
+
+func (e *ResolveError) Error() string {
+	return "xmpp: resolve " + e.Domain + ": " + e.Err.Error()
+}
+
+func (e *ResolveError) Unwrap() error { return e.Err }
+
+// ConnectError is returned when the TCP connection can not be established
+type ConnectError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ConnectError) Error() string {
+	return "xmpp: connect " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *ConnectError) Unwrap() error { return e.Err }
+
+// StreamError is returned when the XML stream negotiation fails
+type StreamError struct {
+	Err error
+}
+
+func (e *StreamError) Error() string {
+	return "xmpp: stream: " + e.Err.Error()
+}
+
+func (e *StreamError) Unwrap() error { return e.Err }
+
+// TLSError is returned when STARTTLS or the TLS handshake fails
+type TLSError struct {
+	Err error
+}
+
+func (e *TLSError) Error() string {
+	return "xmpp: tls: " + e.Err.Error()
+}
+
+func (e *TLSError) Unwrap() error { return e.Err }
+
+// AuthError is returned when SASL authentication fails
+type AuthError struct {
+	Mechanism string
+	Condition string // RFC 6120 # 6.5 — SASL Errors
+	Text      string
+	Err       error
+}
+
+func (e *AuthError) Error() string {
+	msg := "xmpp: authentication"
+	if e.Mechanism != "" {
+		msg += " (" + e.Mechanism + ")"
+	}
+	if e.Condition != "" {
+		msg += ": " + e.Condition
+	}
+	if e.Text != "" {
+		msg += ": " + e.Text
+	}
+	if e.Err != nil && e.Err != saslConditions[e.Condition] {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// Temporary reports whether the server asked to try again later
+func (e *AuthError) Temporary() bool {
+	return e.Condition == "temporary-auth-failure"
+}
+
+// RegisterError is returned when registration, password change or
+// cancellation fails (XEP 0077)
+type RegisterError struct {
+	Condition string // RFC 6120 # 8.3.3 — Defined Conditions
+	Text      string
+	Err       error
+}
+
+func (e *RegisterError) Error() string {
+	msg := "xmpp: registration"
+	if e.Condition != "" {
+		msg += ": " + e.Condition
+	}
+	if e.Text != "" {
+		msg += ": " + e.Text
+	}
+	if e.Condition == "" && e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *RegisterError) Unwrap() error { return e.Err }
+
+// BindError is returned when resource binding fails
+type BindError struct {
+	Resource string
+	Err      error
+}
+
+func (e *BindError) Error() string {
+	return "xmpp: bind " + e.Resource + ": " + e.Err.Error()
+}
+
+func (e *BindError) Unwrap() error { return e.Err }
+
+// Retryable reports whether dialing again may succeed: network and stream
+// failures, a temporary authentication failure or a resource the server can
+// not bind yet. Bad credentials, disabled accounts, certificate errors, a
+// missing STARTTLS, a refused resource and a cancelled context are never
+// retried.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var auth_error *AuthError
+	if errors.As(err, &auth_error) {
+		if auth_error.Condition != "" {
+			return auth_error.Temporary()
+		}
+		// Connection lost during the exchange
+		var net_error net.Error
+		return errors.As(err, &net_error) || errors.Is(err, io.EOF) ||
+			errors.Is(err, ErrClosed) || errors.Is(err, context.DeadlineExceeded)
+	}
+
+	var tls_error *TLSError
+	if errors.As(err, &tls_error) {
+		var verify_error *tls.CertificateVerificationError
+		return !errors.As(err, &verify_error) && !errors.Is(err, ErrCertificatePin) &&
+			!errors.Is(err, ErrStartTLSMissing)
+	}
+
+	if errors.Is(err, ErrServiceUnavailable) {
+		return false
+	}
+
+	var bind_error *BindError
+	if errors.As(err, &bind_error) {
+		// RFC 6120 # 7.6.2.1 — the server may accept the resource later,
+		// conflict and not-allowed are final
+		var stanza_error *StanzaError
+		if errors.As(err, &stanza_error) {
+			return stanza_error.Type == "wait" || stanza_error.Condition == "resource-constraint"
+		}
+		// Connection lost during the exchange
+		var net_error net.Error
+		return errors.As(err, &net_error) || errors.Is(err, io.EOF) ||
+			errors.Is(err, ErrClosed) || errors.Is(err, context.DeadlineExceeded)
+	}
+
+	var resolve_error *ResolveError
+	var connect_error *ConnectError
+	var stream_error *StreamError
+	return errors.As(err, &resolve_error) || errors.As(err, &connect_error) ||
+		errors.As(err, &stream_error) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -1,14 +1,15 @@
 package xmpp
 
 import (
+	"context"
 	"crypto/rand"
-	"encoding/base64"
 	"encoding/binary"
-	"fmt"
 	"github.com/sirupsen/logrus"
 	mathrand "math/rand"
 	"net"
+	"sort"
 	"strings"
+	"time"
 )
 
 const (
@@ -16,6 +17,8 @@ const (
 	nsClient        = "jabber:client"
 	nsStartTLS      = "urn:ietf:params:xml:ns:xmpp-tls"
 	nsSASL          = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsSASL2         = "urn:xmpp:sasl:2"
+	nsStanzas       = "urn:ietf:params:xml:ns:xmpp-stanzas"
 	nsCaps          = "http://jabber.org/protocol/caps"
 	nsBind          = "urn:ietf:params:xml:ns:xmpp-bind"
 	nsPing          = "urn:xmpp:ping"
@@ -30,6 +33,7 @@ const (
 	nsVersion       = "jabber:iq:version"
 	nsRoster        = "jabber:iq:roster"
 	nsRosterVer     = "urn:xmpp:features:rosterver"
+	nsPreApproval   = "urn:xmpp:features:pre-approval"
 	nsPrivate       = "jabber:iq:private"
 	nsRegister      = "jabber:iq:register"
 	nsOffline       = "msgoffline"
@@ -40,47 +44,158 @@ const (
 	nsPubSubPublish = "http://jabber.org/protocol/pubsub#publish"
 )
 
-func resolv_server(account string, custom_domain string) (string, string, string) {
-	var domain string
-	if custom_domain == "" {
-		domain = strings.Split(account, "@")[1]
-	} else {
-		domain = custom_domain
+// Resolver looks up the XMPP server of a domain, *net.Resolver implements it
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// XMPP server found in DNS
+type serverAddr struct {
+	Host string
+	Port uint16
+	// XEP 0368 — TLS starts with the connection, no STARTTLS
+	DirectTLS bool
+}
+
+type srvRecord struct {
+	*net.SRV
+	direct_tls bool
+}
+
+// RFC 6120 # 3.2 — Resolution of Fully Qualified Domain Names. The
+// _xmpps-client records (XEP 0368) are merged with the _xmpp-client ones when
+// direct TLS is allowed. Servers are returned in the order to try them.
+func resolv_server(ctx context.Context, log logrus.FieldLogger, resolver Resolver, domain string, direct_tls bool) ([]*serverAddr, error) {
+	services := []string{"xmpp-client"}
+	if direct_tls {
+		services = append(services, "xmpps-client")
 	}
-	_, srvs, _ := net.LookupSRV("xmpp-client", "tcp", domain)
-
-	var server_choice int
-	if len(srvs) > 0 {
-		// Random choice between SRV records
-		server_choice = mathrand.Intn(len(srvs))
-		logrus.WithFields(logrus.Fields{
-			"nb_entries": len(srvs),
-			"domain":     domain,
-			"addr":       srvs[server_choice].Target,
-			"port":       srvs[server_choice].Port,
-		}).Info("Resolve XMPP server (SRV)")
-		return srvs[server_choice].Target, fmt.Sprint(srvs[server_choice].Port), domain
-	} else {
-		addrs, _ := net.LookupHost(domain)
-		server_choice = mathrand.Intn(len(addrs))
-		logrus.WithFields(logrus.Fields{
+
+	var records []srvRecord
+	unavailable := false
+	for _, service := range services {
+		_, srvs, err := resolver.LookupSRV(ctx, service, "tcp", domain)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, &ResolveError{Domain: domain, Err: ctx.Err()}
+			}
+			// RFC 6120 # 3.2.1 — a failed SRV lookup falls back to A/AAAA
+			log.WithFields(logrus.Fields{
+				"service": service,
+				"domain":  domain,
+				"error":   err,
+			}).Debug("SRV lookup failed")
+			continue
+		}
+		// RFC 2782 — a single "." target: decidedly not available
+		if len(srvs) == 1 && (srvs[0].Target == "." || srvs[0].Target == "") {
+			unavailable = true
+			continue
+		}
+		for _, srv := range srvs {
+			records = append(records, srvRecord{srv, service == "xmpps-client"})
+		}
+	}
+
+	if len(records) == 0 {
+		// RFC 6120 # 3.2.1 — no fallback when the service is refused
+		if unavailable {
+			return nil, &ResolveError{Domain: domain, Err: ErrServiceUnavailable}
+		}
+		log.WithFields(logrus.Fields{
 			"domain": domain,
-			"addr":   addrs[server_choice],
 			"port":   5222,
 		}).Info("Resolve XMPP server (A/AAAA)")
-		return addrs[server_choice], fmt.Sprint(5222), domain
+		return []*serverAddr{{domain, 5222, false}}, nil
+	}
+
+	var servers []*serverAddr
+	for _, record := range srv_order(records) {
+		servers = append(servers, &serverAddr{record.Target, record.Port, record.direct_tls})
 	}
+	log.WithFields(logrus.Fields{
+		"nb_entries": len(servers),
+		"domain":     domain,
+		"addr":       servers[0].Host,
+		"port":       servers[0].Port,
+		"direct_tls": servers[0].DirectTLS,
+	}).Info("Resolve XMPP server (SRV)")
+	return servers, nil
 }
 
-func connect_server(addr string, port string) net.Conn {
-	logrus.WithFields(logrus.Fields{
+// RFC 2782 — lowest priority first, then a weighted random order within a
+// priority
+func srv_order(records []srvRecord) []srvRecord {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+
+	ordered := make([]srvRecord, 0, len(records))
+	for start := 0; start < len(records); {
+		end := start
+		for end < len(records) && records[end].Priority == records[start].Priority {
+			end++
+		}
+		group := append([]srvRecord(nil), records[start:end]...)
+		// Any order, except that zero weight records come first so that
+		// they keep a small chance to be picked
+		mathrand.Shuffle(len(group), func(i, j int) {
+			group[i], group[j] = group[j], group[i]
+		})
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Weight == 0 && group[j].Weight != 0
+		})
+		for len(group) > 0 {
+			total := 0
+			for _, record := range group {
+				total += int(record.Weight)
+			}
+			choice := mathrand.Intn(total + 1)
+			i, sum := 0, 0
+			for ; i < len(group)-1; i++ {
+				sum += int(group[i].Weight)
+				if sum >= choice {
+					break
+				}
+			}
+			ordered = append(ordered, group[i])
+			group = append(group[:i], group[i+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
+
+func connect_server(ctx context.Context, log logrus.FieldLogger, addr string, timeout time.Duration) (net.Conn, error) {
+	log.WithFields(logrus.Fields{
 		"addr": addr,
-		"port": port,
 	}).Info("TCP Connection")
-	conn, err := net.Dial("tcp", addr+":"+port)
-	LogError(err, "Error while initializing TCP connection")
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, &ConnectError{Addr: addr, Err: err}
+	}
+
+	return conn, nil
+}
+
+// Strip the resource of a full JID
+func bare_jid(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[:i]
+	}
+	return jid
+}
 
-	return conn
+// RFC 6120 # 6.3.7 — the simple user name is the localpart, an account
+// without domain is one already
+func jid_localpart(jid string) string {
+	jid = bare_jid(jid)
+	if i := strings.LastIndex(jid, "@"); i >= 0 {
+		return jid[:i]
+	}
+	return jid
 }
 
 // Cookie is a unique XMPP session identifier
@@ -93,11 +208,3 @@ func get_cookie() Cookie {
 	}
 	return Cookie(binary.LittleEndian.Uint64(buf[:]))
 }
-
-func create_user_hash(account string, password string) []byte {
-	raw := "\x00" + account + "\x00" + password
-	enc := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
-	base64.StdEncoding.Encode(enc, []byte(raw))
-
-	return enc
-}
@@ -0,0 +1,517 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Resolver answering from maps, unknown names fail like NXDOMAIN
+type testResolver struct {
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (resolver *testResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if records, ok := resolver.srv[service]; ok {
+		return "_" + service + "._" + proto + "." + name, records, nil
+	}
+	return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (resolver *testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := resolver.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func testListener(t *testing.T) (net.Listener, uint16) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener, uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Accept connections and answer garbage, the TLS handshake fails
+func serveGarbage(listener net.Listener) {
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+}
+
+func testDomainConfig(ca *testAuthority, resolver Resolver) ClientConfig {
+	return ClientConfig{
+		Account:  "user@example.org",
+		Password: "secret",
+		Resource: "res",
+		RootCAs:  ca.pool,
+		Resolver: resolver,
+	}
+}
+
+func TestDirectTLSFailover(t *testing.T) {
+	ca := newTestAuthority(t)
+	server_conf := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.org", false)}}
+
+	broken, broken_port := testListener(t)
+	serveGarbage(broken)
+	starttls, starttls_port := testListener(t)
+	auth := serveTestClient(starttls, server_conf, `<mechanism>PLAIN</mechanism>`, false)
+
+	resolver := &testResolver{
+		srv: map[string][]*net.SRV{
+			"xmpps-client": {{Target: "tls.example.org.", Port: broken_port, Priority: 0}},
+			"xmpp-client":  {{Target: "xmpp.example.org.", Port: starttls_port, Priority: 10}},
+		},
+		hosts: map[string][]string{
+			"tls.example.org":  {"127.0.0.1"},
+			"xmpp.example.org": {"127.0.0.1"},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	xmpp, err := Dial(ctx, testDomainConfig(ca, resolver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer xmpp.Close()
+	if payload := <-auth; !strings.HasPrefix(payload, "PLAIN ") {
+		t.Errorf("auth = %q", payload)
+	}
+	if xmpp.tls == nil {
+		t.Error("stream is not encrypted")
+	}
+}
+
+func TestDirectTLSNoFailoverOnUntrustedCertificate(t *testing.T) {
+	ca := newTestAuthority(t)
+	other := newTestAuthority(t)
+	server_conf := &tls.Config{
+		Certificates: []tls.Certificate{other.issue(t, "example.org", false)},
+		NextProtos:   []string{"xmpp-client"},
+	}
+
+	untrusted, untrusted_port := testListener(t)
+	serveTestClient(untrusted, server_conf, `<mechanism>PLAIN</mechanism>`, true)
+	fallback, fallback_port := testListener(t)
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if conn, err := fallback.Accept(); err == nil {
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+
+	resolver := &testResolver{
+		srv: map[string][]*net.SRV{
+			"xmpps-client": {{Target: "tls.example.org.", Port: untrusted_port, Priority: 0}},
+			"xmpp-client":  {{Target: "xmpp.example.org.", Port: fallback_port, Priority: 10}},
+		},
+		hosts: map[string][]string{
+			"tls.example.org":  {"127.0.0.1"},
+			"xmpp.example.org": {"127.0.0.1"},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := Dial(ctx, testDomainConfig(ca, resolver))
+	var verify_error *tls.CertificateVerificationError
+	if !errors.As(err, &verify_error) {
+		t.Fatalf("err = %v, want a certificate verification error", err)
+	}
+	select {
+	case <-accepted:
+		t.Error("fell back to another server after a certificate failure")
+	default:
+	}
+}
+
+// XEP 0368 — the direct TLS connection announces xmpp-client and checks the
+// certificate against the XMPP domain, never the SRV target
+func TestDirectTLSIdentity(t *testing.T) {
+	ca := newTestAuthority(t)
+	for _, test := range []struct {
+		name        string
+		certificate string
+		ok          bool
+	}{
+		{"domain certificate", "example.org", true},
+		{"target certificate", "tls.example.org", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hello := make(chan *tls.ClientHelloInfo, 1)
+			server_conf := &tls.Config{
+				Certificates: []tls.Certificate{ca.issue(t, test.certificate, false)},
+				NextProtos:   []string{"xmpp-client"},
+				GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+					hello <- info
+					return nil, nil
+				},
+			}
+			listener, port := testListener(t)
+			serveTestClient(listener, server_conf, `<mechanism>PLAIN</mechanism>`, true)
+			resolver := &testResolver{
+				srv: map[string][]*net.SRV{
+					"xmpps-client": {{Target: "tls.example.org.", Port: port}},
+				},
+				hosts: map[string][]string{"tls.example.org": {"127.0.0.1"}},
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			xmpp, err := Dial(ctx, testDomainConfig(ca, resolver))
+
+			select {
+			case info := <-hello:
+				if info.ServerName != "example.org" {
+					t.Errorf("SNI = %q, want example.org", info.ServerName)
+				}
+				if len(info.SupportedProtos) != 1 || info.SupportedProtos[0] != "xmpp-client" {
+					t.Errorf("ALPN = %v, want xmpp-client", info.SupportedProtos)
+				}
+			default:
+				t.Fatal("no TLS handshake")
+			}
+			if !test.ok {
+				var verify_error *tls.CertificateVerificationError
+				if !errors.As(err, &verify_error) {
+					t.Fatalf("err = %v, want a certificate verification error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer xmpp.Close()
+			if protocol := xmpp.tls.ConnectionState().NegotiatedProtocol; protocol != "xmpp-client" {
+				t.Errorf("negotiated protocol = %q", protocol)
+			}
+		})
+	}
+}
+
+func testRecords(records ...srvRecord) []srvRecord {
+	return append([]srvRecord(nil), records...)
+}
+
+func TestSrvOrderPriority(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		records []srvRecord
+		want    []uint16
+	}{
+		{"sorted", testRecords(
+			srvRecord{&net.SRV{Target: "a.", Priority: 0, Weight: 10}, false},
+			srvRecord{&net.SRV{Target: "b.", Priority: 10, Weight: 10}, false},
+		), []uint16{0, 10}},
+		{"reversed", testRecords(
+			srvRecord{&net.SRV{Target: "a.", Priority: 30, Weight: 10}, false},
+			srvRecord{&net.SRV{Target: "b.", Priority: 20, Weight: 0}, true},
+			srvRecord{&net.SRV{Target: "c.", Priority: 10, Weight: 5}, false},
+		), []uint16{10, 20, 30}},
+		{"groups", testRecords(
+			srvRecord{&net.SRV{Target: "a.", Priority: 20, Weight: 1}, false},
+			srvRecord{&net.SRV{Target: "b.", Priority: 10, Weight: 1}, true},
+			srvRecord{&net.SRV{Target: "c.", Priority: 20, Weight: 1}, false},
+			srvRecord{&net.SRV{Target: "d.", Priority: 10, Weight: 1}, false},
+		), []uint16{10, 10, 20, 20}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for n := 0; n < 100; n++ {
+				ordered := srv_order(testRecords(test.records...))
+				if len(ordered) != len(test.want) {
+					t.Fatalf("%d records, want %d", len(ordered), len(test.want))
+				}
+				seen := make(map[string]bool)
+				for i, record := range ordered {
+					if record.Priority != test.want[i] {
+						t.Fatalf("record %d has priority %d, want %d", i, record.Priority, test.want[i])
+					}
+					seen[record.Target] = true
+				}
+				if len(seen) != len(test.records) {
+					t.Fatalf("records lost: %v", seen)
+				}
+			}
+		})
+	}
+}
+
+// First record of many orderings, by target
+func testFirstTargets(records []srvRecord, rounds int) map[string]int {
+	first := make(map[string]int)
+	for n := 0; n < rounds; n++ {
+		ordered := srv_order(testRecords(records...))
+		first[ordered[0].Target]++
+	}
+	return first
+}
+
+func TestSrvOrderWeight(t *testing.T) {
+	const rounds = 10000
+	for _, test := range []struct {
+		name    string
+		records []srvRecord
+		// Expected share of each target in first position
+		want map[string]float64
+	}{
+		// The record shuffled first also wins when the random number is 0
+		{"weighted", testRecords(
+			srvRecord{&net.SRV{Target: "a.", Weight: 60}, false},
+			srvRecord{&net.SRV{Target: "b.", Weight: 30}, false},
+			srvRecord{&net.SRV{Target: "c.", Weight: 10}, false},
+		), map[string]float64{"a.": (60 + 1.0/3) / 101, "b.": (30 + 1.0/3) / 101, "c.": (10 + 1.0/3) / 101}},
+		// A zero weight record is picked only when the random number is 0
+		{"zero weight", testRecords(
+			srvRecord{&net.SRV{Target: "a.", Weight: 99}, false},
+			srvRecord{&net.SRV{Target: "z.", Weight: 0}, false},
+		), map[string]float64{"a.": 99.0 / 100, "z.": 1.0 / 100}},
+		{"all zero weight", testRecords(
+			srvRecord{&net.SRV{Target: "a.", Weight: 0}, false},
+			srvRecord{&net.SRV{Target: "b.", Weight: 0}, false},
+		), map[string]float64{"a.": 0.5, "b.": 0.5}},
+		// Lower priority records are never first, whatever their weight
+		{"priority first", testRecords(
+			srvRecord{&net.SRV{Target: "a.", Priority: 1, Weight: 1000}, false},
+			srvRecord{&net.SRV{Target: "b.", Priority: 0, Weight: 1}, false},
+		), map[string]float64{"a.": 0, "b.": 1}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			first := testFirstTargets(test.records, rounds)
+			for target, share := range test.want {
+				// Five standard deviations of a binomial distribution
+				expected := share * rounds
+				margin := 5*math.Sqrt(rounds*share*(1-share)) + 1
+				if got := float64(first[target]); math.Abs(got-expected) > margin {
+					t.Errorf("%s first %v times, want %.0f ± %.0f", target, got, expected, margin)
+				}
+			}
+		})
+	}
+}
+
+func TestResolvServer(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		srv        map[string][]*net.SRV
+		direct_tls bool
+		want       []serverAddr
+		err        error
+	}{
+		{
+			name: "STARTTLS records",
+			srv: map[string][]*net.SRV{
+				"xmpp-client": {
+					{Target: "backup.example.org.", Port: 5223, Priority: 20},
+					{Target: "xmpp.example.org.", Port: 5222, Priority: 10},
+				},
+			},
+			direct_tls: true,
+			want: []serverAddr{
+				{"xmpp.example.org.", 5222, false},
+				{"backup.example.org.", 5223, false},
+			},
+		},
+		{
+			name: "merged by priority",
+			srv: map[string][]*net.SRV{
+				"xmpp-client":  {{Target: "xmpp.example.org.", Port: 5222, Priority: 10}},
+				"xmpps-client": {{Target: "xmpp.example.org.", Port: 443, Priority: 5}},
+			},
+			direct_tls: true,
+			want: []serverAddr{
+				{"xmpp.example.org.", 443, true},
+				{"xmpp.example.org.", 5222, false},
+			},
+		},
+		{
+			name: "direct TLS not allowed",
+			srv: map[string][]*net.SRV{
+				"xmpp-client":  {{Target: "xmpp.example.org.", Port: 5222, Priority: 10}},
+				"xmpps-client": {{Target: "xmpp.example.org.", Port: 443, Priority: 5}},
+			},
+			want: []serverAddr{{"xmpp.example.org.", 5222, false}},
+		},
+		{
+			name: "service unavailable",
+			srv:  map[string][]*net.SRV{"xmpp-client": {{Target: "."}}},
+			err:  ErrServiceUnavailable,
+		},
+		{
+			name: "unavailable without direct TLS",
+			srv: map[string][]*net.SRV{
+				"xmpp-client":  {{Target: "."}},
+				"xmpps-client": {{Target: "."}},
+			},
+			direct_tls: true,
+			err:        ErrServiceUnavailable,
+		},
+		{
+			name: "only direct TLS available",
+			srv: map[string][]*net.SRV{
+				"xmpp-client":  {{Target: "."}},
+				"xmpps-client": {{Target: "xmpp.example.org.", Port: 443}},
+			},
+			direct_tls: true,
+			want:       []serverAddr{{"xmpp.example.org.", 443, true}},
+		},
+		{
+			name:       "lookup error",
+			direct_tls: true,
+			want:       []serverAddr{{"example.org", 5222, false}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &testResolver{srv: test.srv}
+			servers, err := resolv_server(context.Background(), logrus.New(), resolver, "example.org", test.direct_tls)
+			if test.err != nil {
+				var resolve_error *ResolveError
+				if !errors.Is(err, test.err) || !errors.As(err, &resolve_error) {
+					t.Fatalf("err = %v, want %v", err, test.err)
+				}
+				if Retryable(err) {
+					t.Error("unavailable service is retryable")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(servers) != len(test.want) {
+				t.Fatalf("%d servers, want %d", len(servers), len(test.want))
+			}
+			for i, server := range servers {
+				if *server != test.want[i] {
+					t.Errorf("server %d = %+v, want %+v", i, *server, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+// Port of a closed listener, connections are refused
+func testClosedPort(t *testing.T) uint16 {
+	t.Helper()
+	listener, port := testListener(t)
+	listener.Close()
+	return port
+}
+
+func TestNegotiateFailover(t *testing.T) {
+	ca := newTestAuthority(t)
+	server_conf := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.org", false)}}
+	listener, port := testListener(t)
+	closed := testClosedPort(t)
+
+	for _, test := range []struct {
+		name  string
+		srv   []*net.SRV
+		hosts map[string][]string
+	}{
+		{
+			name: "next target",
+			srv: []*net.SRV{
+				{Target: "refused.example.org.", Port: closed, Priority: 0},
+				{Target: "xmpp.example.org.", Port: port, Priority: 10},
+			},
+			hosts: map[string][]string{
+				"refused.example.org": {"127.0.0.1"},
+				"xmpp.example.org":    {"127.0.0.1"},
+			},
+		},
+		{
+			// 127.0.0.2 is loopback too, nothing listens there
+			name: "next address",
+			srv:  []*net.SRV{{Target: "xmpp.example.org.", Port: port}},
+			hosts: map[string][]string{
+				"xmpp.example.org": {"127.0.0.2", "127.0.0.1"},
+			},
+		},
+		{
+			name: "target without address",
+			srv: []*net.SRV{
+				{Target: "empty.example.org.", Port: port, Priority: 0},
+				{Target: "unknown.example.org.", Port: port, Priority: 1},
+				{Target: "xmpp.example.org.", Port: port, Priority: 2},
+			},
+			hosts: map[string][]string{
+				"empty.example.org": {},
+				"xmpp.example.org":  {"127.0.0.1"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			auth := serveTestClient(listener, server_conf, `<mechanism>PLAIN</mechanism>`, false)
+			resolver := &testResolver{
+				srv:   map[string][]*net.SRV{"xmpp-client": test.srv},
+				hosts: test.hosts,
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			xmpp, err := Dial(ctx, testDomainConfig(ca, resolver))
+			if err != nil {
+				t.Fatal(err)
+			}
+			xmpp.Close()
+			<-auth
+		})
+	}
+}
+
+func TestNegotiateNoAddress(t *testing.T) {
+	ca := newTestAuthority(t)
+	for _, test := range []struct {
+		name     string
+		resolver *testResolver
+	}{
+		{"empty host lookup", &testResolver{
+			hosts: map[string][]string{"example.org": {}},
+		}},
+		{"failed host lookup", &testResolver{}},
+		{"no target address", &testResolver{
+			srv: map[string][]*net.SRV{"xmpp-client": {
+				{Target: "a.example.org.", Port: 5222, Priority: 0},
+				{Target: "b.example.org.", Port: 5222, Priority: 1},
+			}},
+			hosts: map[string][]string{"a.example.org": {}},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := negotiate(context.Background(), testDomainConfig(ca, test.resolver))
+			var resolve_error *ResolveError
+			if !errors.As(err, &resolve_error) {
+				t.Fatalf("err = %v, want *ResolveError", err)
+			}
+		})
+	}
+}
+
+func TestJidLocalpart(t *testing.T) {
+	for jid, want := range map[string]string{
+		"user@example.org":     "user",
+		"user@example.org/res": "user",
+		"user":                 "user",
+		"example.org":          "example.org",
+	} {
+		if localpart := jid_localpart(jid); localpart != want {
+			t.Errorf("jid_localpart(%q) = %q, want %q", jid, localpart, want)
+		}
+	}
+}
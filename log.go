@@ -29,36 +29,42 @@ func LogError(err error, prefix string) {
 }
 
 func LogInOut(direction string, xml string) {
+	logInOut(logrus.StandardLogger(), direction, xml)
+}
+
+func logInOut(log logrus.FieldLogger, direction string, xml string) {
 	if direction == "in" {
-		logrus.Debug(in(xml))
+		log.Debug(in(xml))
 	} else if direction == "out" {
-		logrus.Debug(out(xml))
+		log.Debug(out(xml))
 	} else {
-		logrus.Debug(xml)
+		log.Debug(xml)
 	}
 
 }
 
 type teeIn struct {
-	r io.Reader
+	r   io.Reader
+	log logrus.FieldLogger
 }
 
 func (t teeIn) Read(p []byte) (n int, err error) {
 	n, err = t.r.Read(p)
 	if n > 0 {
-		LogInOut("in", string(p[0:n]))
+		logInOut(t.log, "in", string(p[0:n]))
 	}
 	return
 }
 
 type teeOut struct {
-	w io.Writer
+	w   io.Writer
+	log logrus.FieldLogger
 }
 
 func (t teeOut) Write(p []byte) (n int, err error) {
 	n, err = t.w.Write(p)
 	if n > 0 {
-		LogInOut("out", string(p[0:n]))
+		logInOut(t.log, "out", string(p[0:n]))
 	}
 	return
 }
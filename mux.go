@@ -0,0 +1,160 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+)
+
+// Handlers are called from the Process goroutine, one stanza at a time.
+// They must not wait for an IQ response (SendIQ) without starting their own
+// goroutine, otherwise the response is never delivered.
+type IQHandler func(xmpp *XMPPConnection, iq *IQ)
+type MessageHandler func(xmpp *XMPPConnection, message *Message)
+type PresenceHandler func(xmpp *XMPPConnection, presence *Presence)
+
+type iqRoute struct {
+	Type string
+	Name xml.Name
+}
+
+// Mux dispatches incoming stanzas to handlers registered by stanza kind and
+// payload name. The zero xml.Name registers a catch-all handler for a kind.
+type Mux struct {
+	lock     sync.RWMutex
+	iq       map[iqRoute]IQHandler
+	message  map[xml.Name]MessageHandler
+	presence map[xml.Name]PresenceHandler
+	// Namespaces advertised with disco#info (XEP 0030)
+	features map[string]bool
+}
+
+func NewMux() *Mux {
+	return &Mux{
+		iq:       make(map[iqRoute]IQHandler),
+		message:  make(map[xml.Name]MessageHandler),
+		presence: make(map[xml.Name]PresenceHandler),
+		features: make(map[string]bool),
+	}
+}
+
+// HandleIQ registers a handler for IQ of type get or set carrying the payload
+func (mux *Mux) HandleIQ(iq_type string, payload xml.Name, handler IQHandler) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	mux.iq[iqRoute{iq_type, payload}] = handler
+}
+
+// HandleMessage registers a handler for messages carrying the payload
+func (mux *Mux) HandleMessage(payload xml.Name, handler MessageHandler) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	mux.message[payload] = handler
+}
+
+// HandlePresence registers a handler for presences carrying the payload
+func (mux *Mux) HandlePresence(payload xml.Name, handler PresenceHandler) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	mux.presence[payload] = handler
+}
+
+// Register a built-in IQ handler unless the user already did
+func (mux *Mux) handleIQDefault(iq_type string, payload xml.Name, handler IQHandler) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	if _, ok := mux.iq[iqRoute{iq_type, payload}]; !ok {
+		mux.iq[iqRoute{iq_type, payload}] = handler
+	}
+}
+
+// Register a built-in message handler unless the user already did
+func (mux *Mux) handleMessageDefault(payload xml.Name, handler MessageHandler) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	if _, ok := mux.message[payload]; !ok {
+		mux.message[payload] = handler
+	}
+}
+
+// AddFeature advertises namespaces in the disco#info answer. Registering a
+// handler advertises nothing by itself.
+func (mux *Mux) AddFeature(features ...string) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	for _, feature := range features {
+		mux.features[feature] = true
+	}
+}
+
+// Features returns the advertised namespaces, sorted
+func (mux *Mux) Features() []string {
+	mux.lock.RLock()
+	defer mux.lock.RUnlock()
+
+	features := make([]string, 0, len(mux.features))
+	for feature := range mux.features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+func (mux *Mux) dispatchIQ(xmpp *XMPPConnection, iq *IQ) {
+	mux.lock.RLock()
+	handler, ok := mux.iq[iqRoute{iq.Type, iq.payloadName()}]
+	if !ok {
+		handler, ok = mux.iq[iqRoute{iq.Type, xml.Name{}}]
+	}
+	mux.lock.RUnlock()
+
+	if ok {
+		handler(xmpp, iq)
+		return
+	}
+
+	// RFC 6120 # 8.2.3 — an entity must answer every IQ get or set
+	xmpp.log.WithFields(logrus.Fields{
+		"id":      iq.ID,
+		"from":    iq.From,
+		"payload": iq.payloadName().Space + " " + iq.payloadName().Local,
+	}).Debug("No handler for IQ, answering service-unavailable")
+	xmpp.Send(context.Background(), iq.ErrorResult(&StanzaError{
+		Type:      "cancel",
+		Condition: "service-unavailable",
+	}))
+}
+
+func (mux *Mux) dispatchMessage(xmpp *XMPPConnection, message *Message) {
+	mux.lock.RLock()
+	handler := mux.message[xml.Name{}]
+	for _, payload := range message.Extensions {
+		if h, ok := mux.message[payload.XMLName]; ok {
+			handler = h
+			break
+		}
+	}
+	mux.lock.RUnlock()
+
+	if handler != nil {
+		handler(xmpp, message)
+	}
+}
+
+func (mux *Mux) dispatchPresence(xmpp *XMPPConnection, presence *Presence) {
+	mux.lock.RLock()
+	handler := mux.presence[xml.Name{}]
+	for _, payload := range presence.Extensions {
+		if h, ok := mux.presence[payload.XMLName]; ok {
+			handler = h
+			break
+		}
+	}
+	mux.lock.RUnlock()
+
+	if handler != nil {
+		handler(xmpp, presence)
+	}
+}
@@ -0,0 +1,214 @@
+// RFC 4422 — Simple Authentication and Security Layer (SASL)
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+)
+
+// Mechanism is the client side of a SASL mechanism, a new one is created for
+// every authentication
+type Mechanism interface {
+	Name() string
+	// Start returns the initial response, nil to send none
+	Start() ([]byte, error)
+	// Next answers a challenge. It is called one last time with the
+	// additional data of the success, which may be empty.
+	Next(challenge []byte) ([]byte, error)
+}
+
+// MechanismFactory creates a mechanism for these credentials. It returns nil
+// when the mechanism can not run with them, for instance a -PLUS mechanism
+// without channel binding.
+type MechanismFactory func(credentials *Credentials) Mechanism
+
+// MechanismPolicy decides whether a mechanism may run over the current TLS
+// session, state is nil without TLS. A policy only restricts: PLAIN is
+// refused without TLS whatever it answers.
+type MechanismPolicy func(mechanism string, state *tls.ConnectionState) bool
+
+// Credentials is what a mechanism may use to authenticate
+type Credentials struct {
+	Account  string
+	Password string
+	Domain   string
+	// AuthzID is the identity to act as, empty for the authenticated one
+	AuthzID string
+	// A client certificate is configured for the TLS session
+	ClientCertificate bool
+	// Channel binding, empty type when unavailable (XEP 0440)
+	ChannelBindingType string
+	ChannelBinding     []byte
+	// The server offered at least one -PLUS mechanism
+	ServerPlus bool
+	TLS        *tls.ConnectionState
+}
+
+// Supported mechanisms, strongest first
+var defaultMechanisms = []string{
+	"EXTERNAL",
+	"SCRAM-SHA-512-PLUS",
+	"SCRAM-SHA-256-PLUS",
+	"SCRAM-SHA-1-PLUS",
+	"SCRAM-SHA-512",
+	"SCRAM-SHA-256",
+	"SCRAM-SHA-1",
+	"PLAIN",
+	"ANONYMOUS",
+}
+
+var (
+	mechanismRegistry     = make(map[string]MechanismFactory)
+	mechanismRegistryLock sync.RWMutex
+)
+
+func init() {
+	for _, name := range defaultMechanisms {
+		if strings.HasPrefix(name, "SCRAM-") {
+			RegisterMechanism(name, scramFactory(name))
+		}
+	}
+	RegisterMechanism("EXTERNAL", newExternal)
+	RegisterMechanism("PLAIN", func(credentials *Credentials) Mechanism {
+		if credentials.Account == "" {
+			return nil
+		}
+		return &plainMechanism{account: credentials.Account, password: credentials.Password}
+	})
+	RegisterMechanism("ANONYMOUS", newAnonymous)
+}
+
+// RegisterMechanism makes a SASL mechanism available, replacing any
+// mechanism of the same name. Mechanisms not in the defaults must also be
+// listed in ClientConfig.Mechanisms to be used.
+func RegisterMechanism(name string, factory MechanismFactory) {
+	mechanismRegistryLock.Lock()
+	defer mechanismRegistryLock.Unlock()
+	mechanismRegistry[name] = factory
+}
+
+// Return nil when the mechanism is unknown or can not run with these
+// credentials
+func newMechanism(name string, credentials *Credentials) Mechanism {
+	mechanismRegistryLock.RLock()
+	factory, ok := mechanismRegistry[name]
+	mechanismRegistryLock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return factory(credentials)
+}
+
+// Gather what the mechanisms need, including the TLS channel binding
+func (xmpp *XMPPConnection) credentials(account string, password string, domain string, offered []string) *Credentials {
+	credentials := &Credentials{
+		Account:  account,
+		Password: password,
+		Domain:   domain,
+		AuthzID:  xmpp.config.AuthzID,
+	}
+	for _, mechanism := range offered {
+		if strings.HasSuffix(mechanism, "-PLUS") {
+			credentials.ServerPlus = true
+		}
+	}
+	if xmpp.tls != nil && xmpp.features != nil {
+		state := xmpp.tls.ConnectionState()
+		credentials.TLS = &state
+		conf := xmpp.config.tlsConfig(domain)
+		credentials.ClientCertificate = len(conf.Certificates) > 0 || conf.GetClientCertificate != nil
+		binding_type := select_channel_binding(&state, xmpp.features.ChannelBinding)
+		if binding_type != "" {
+			data, err := channel_binding_data(&state, binding_type)
+			if err == nil {
+				credentials.ChannelBindingType = binding_type
+				credentials.ChannelBinding = data
+			} else {
+				xmpp.log.WithFields(logrus.Fields{
+					"type":  binding_type,
+					"error": err,
+				}).Warn("[XEP 0440] Channel binding unavailable")
+			}
+		}
+	}
+	return credentials
+}
+
+// Create the preferred SASL mechanism also offered by the server and
+// allowed by the policy
+func (xmpp *XMPPConnection) selectMechanism(credentials *Credentials, offered []string) (Mechanism, error) {
+	for _, name := range xmpp.config.mechanisms() {
+		is_offered := false
+		for _, mechanism := range offered {
+			if mechanism == name {
+				is_offered = true
+				break
+			}
+		}
+		if !is_offered {
+			continue
+		}
+		if !xmpp.allowMechanism(name, credentials) {
+			continue
+		}
+		if mechanism := newMechanism(name, credentials); mechanism != nil {
+			return mechanism, nil
+		}
+	}
+	return nil, ErrNoMechanism
+}
+
+// Whether the mechanism may run over the TLS session of the credentials,
+// FAST mechanisms included
+func (xmpp *XMPPConnection) allowMechanism(name string, credentials *Credentials) bool {
+	// The password would be sent in clear
+	if name == "PLAIN" && credentials.TLS == nil {
+		xmpp.log.Warn("PLAIN refused without TLS")
+		return false
+	}
+	if xmpp.config.MechanismPolicy != nil && !xmpp.config.MechanismPolicy(name, credentials.TLS) {
+		xmpp.log.WithField("mechanism", name).Debug("Mechanism refused by policy")
+		return false
+	}
+	return true
+}
+
+// RFC 6120 # 6.4.2 — an empty response is sent as "="
+func sasl_encode(data []byte) string {
+	if data == nil {
+		return ""
+	}
+	if len(data) == 0 {
+		return "="
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func sasl_decode(data string) ([]byte, error) {
+	data = strings.TrimSpace(data)
+	if data == "" || data == "=" {
+		return []byte{}, nil
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// RFC 4616 — The PLAIN SASL Mechanism
+type plainMechanism struct {
+	account  string
+	password string
+}
+
+func (plain *plainMechanism) Name() string {
+	return "PLAIN"
+}
+
+func (plain *plainMechanism) Start() ([]byte, error) {
+	return []byte("\x00" + plain.account + "\x00" + plain.password), nil
+}
+
+func (plain *plainMechanism) Next(challenge []byte) ([]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,36 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"testing"
+)
+
+func TestPlainWithoutTLS(t *testing.T) {
+	allow := func(mechanism string, state *tls.ConnectionState) bool { return true }
+	for _, test := range []struct {
+		name   string
+		policy MechanismPolicy
+		state  *tls.ConnectionState
+		err    error
+	}{
+		{"no policy", nil, nil, ErrNoMechanism},
+		{"policy allowing everything", allow, nil, ErrNoMechanism},
+		{"TLS", nil, &tls.ConnectionState{}, nil},
+		{"TLS and policy", allow, &tls.ConnectionState{}, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			xmpp := &XMPPConnection{config: ClientConfig{MechanismPolicy: test.policy}, log: logrus.New()}
+			credentials := &Credentials{Account: "user", Password: "secret", Domain: "example.org", TLS: test.state}
+
+			mechanism, err := xmpp.selectMechanism(credentials, []string{"PLAIN"})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if err == nil && mechanism.Name() != "PLAIN" {
+				t.Errorf("mechanism = %s, want PLAIN", mechanism.Name())
+			}
+		})
+	}
+}
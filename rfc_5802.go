@@ -0,0 +1,215 @@
+// RFC 5802 — Salted Challenge Response Authentication Mechanism (SCRAM)
+// RFC 7677 — SCRAM-SHA-256 and SCRAM-SHA-256-PLUS
+package xmpp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+var (
+	scramSHA1   = sha1.New
+	scramSHA256 = sha256.New
+	scramSHA512 = sha512.New
+)
+
+type scramMechanism struct {
+	name     string
+	hash     func() hash.Hash
+	username string
+	password string
+
+	gs2_header        string
+	channel_binding   []byte
+	client_nonce      string
+	client_first_bare string
+	server_signature  []byte
+	step              int
+}
+
+func scramFactory(name string) MechanismFactory {
+	return func(credentials *Credentials) Mechanism {
+		if credentials.Account == "" {
+			return nil
+		}
+		if strings.HasSuffix(name, "-PLUS") && credentials.ChannelBindingType == "" {
+			return nil
+		}
+		return newScram(name, credentials)
+	}
+}
+
+func newScram(name string, credentials *Credentials) *scramMechanism {
+	scram := &scramMechanism{
+		name:       name,
+		hash:       scram_hash(strings.TrimSuffix(name, "-PLUS")),
+		username:   jid_localpart(credentials.Account),
+		password:   credentials.Password,
+		gs2_header: "n,,",
+	}
+	// RFC 5802 # 6 — "y" tells the server we could have bound the channel,
+	// so that a stripped -PLUS mechanism is detected
+	if credentials.ChannelBindingType != "" && !credentials.ServerPlus {
+		scram.gs2_header = "y,,"
+	}
+
+	// RFC 5802 # 6 — Channel Binding
+	if strings.HasSuffix(name, "-PLUS") {
+		scram.gs2_header = "p=" + credentials.ChannelBindingType + ",,"
+		scram.channel_binding = credentials.ChannelBinding
+	}
+	return scram
+}
+
+func scram_hash(name string) func() hash.Hash {
+	switch name {
+	case "SCRAM-SHA-512":
+		return scramSHA512
+	case "SCRAM-SHA-256":
+		return scramSHA256
+	}
+	return scramSHA1
+}
+
+// RFC 5802 # 5.1 — SCRAM Attributes, "=" and "," are escaped in names
+func scram_name(name string) string {
+	name = strings.ReplaceAll(name, "=", "=3D")
+	return strings.ReplaceAll(name, ",", "=2C")
+}
+
+// RFC 5802 # 3 — Hi(str, salt, i), PBKDF2 with the hash output size
+func scram_hi(hash func() hash.Hash, password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(hash, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func scram_hmac(hash func() hash.Hash, key []byte, data []byte) []byte {
+	mac := hmac.New(hash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Parse "a=value,b=value" attributes
+func scram_attributes(message string) map[byte]string {
+	attributes := make(map[byte]string)
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) >= 2 && attr[1] == '=' {
+			attributes[attr[0]] = attr[2:]
+		}
+	}
+	return attributes
+}
+
+func (scram *scramMechanism) Name() string {
+	return scram.name
+}
+
+// RFC 5802 # 5.1 — client-first-message
+func (scram *scramMechanism) Start() ([]byte, error) {
+	if scram.client_nonce == "" {
+		nonce := make([]byte, 24)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		scram.client_nonce = base64.RawStdEncoding.EncodeToString(nonce)
+	}
+	scram.client_first_bare = "n=" + scram_name(scram.username) + ",r=" + scram.client_nonce
+	scram.step = 1
+	return []byte(scram.gs2_header + scram.client_first_bare), nil
+}
+
+func (scram *scramMechanism) Next(challenge []byte) ([]byte, error) {
+	switch scram.step {
+	case 1:
+		scram.step = 2
+		return scram.clientFinal(string(challenge), scram.channel_binding)
+	case 2:
+		scram.step = 3
+		return nil, scram.verifyServer(string(challenge))
+	case 3:
+		// Server final message already verified, success carries nothing
+		if len(challenge) == 0 {
+			return nil, nil
+		}
+	}
+	return nil, errors.New("unexpected SCRAM message")
+}
+
+// RFC 5802 # 3 — client-final-message with the client proof
+func (scram *scramMechanism) clientFinal(server_first string, channel_binding []byte) ([]byte, error) {
+	attributes := scram_attributes(server_first)
+	if e, ok := attributes['e']; ok {
+		return nil, errors.New("SCRAM server error: " + e)
+	}
+	nonce := attributes['r']
+	if !strings.HasPrefix(nonce, scram.client_nonce) || len(nonce) == len(scram.client_nonce) {
+		return nil, errors.New("SCRAM server nonce mismatch")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes['s'])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("SCRAM invalid salt")
+	}
+	iterations, err := strconv.Atoi(attributes['i'])
+	if err != nil || iterations < 1 {
+		return nil, errors.New("SCRAM invalid iteration count")
+	}
+
+	salted_password := scram_hi(scram.hash, []byte(scram.password), salt, iterations)
+	client_key := scram_hmac(scram.hash, salted_password, []byte("Client Key"))
+	h := scram.hash()
+	h.Write(client_key)
+	stored_key := h.Sum(nil)
+
+	cbind_input := append([]byte(scram.gs2_header), channel_binding...)
+	client_final_without_proof := "c=" + base64.StdEncoding.EncodeToString(cbind_input) + ",r=" + nonce
+	auth_message := scram.client_first_bare + "," + server_first + "," + client_final_without_proof
+
+	client_signature := scram_hmac(scram.hash, stored_key, []byte(auth_message))
+	client_proof := make([]byte, len(client_key))
+	for i := range client_key {
+		client_proof[i] = client_key[i] ^ client_signature[i]
+	}
+
+	server_key := scram_hmac(scram.hash, salted_password, []byte("Server Key"))
+	scram.server_signature = scram_hmac(scram.hash, server_key, []byte(auth_message))
+
+	return []byte(client_final_without_proof + ",p=" + base64.StdEncoding.EncodeToString(client_proof)), nil
+}
+
+// RFC 5802 # 3 — the server proves it knows the salted password too
+func (scram *scramMechanism) verifyServer(server_final string) error {
+	attributes := scram_attributes(server_final)
+	if e, ok := attributes['e']; ok {
+		return errors.New("SCRAM server error: " + e)
+	}
+	verifier, err := base64.StdEncoding.DecodeString(attributes['v'])
+	if err != nil || len(verifier) == 0 {
+		return errors.New("SCRAM missing server signature")
+	}
+	if subtle.ConstantTimeCompare(verifier, scram.server_signature) != 1 {
+		return errors.New("SCRAM server signature mismatch")
+	}
+	return nil
+}
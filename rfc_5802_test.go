@@ -0,0 +1,106 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+// RFC 5802 # 5 and RFC 7677 # 3 — example exchanges
+var scramVectors = []struct {
+	name         string
+	nonce        string
+	client_first string
+	server_first string
+	client_final string
+	server_final string
+}{
+	{
+		name:         "SCRAM-SHA-1",
+		nonce:        "fyko+d2lbbFgONRv9qkxdawL",
+		client_first: "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+		server_first: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		client_final: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		server_final: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	},
+	{
+		name:         "SCRAM-SHA-256",
+		nonce:        "rOprNGfwEbeRWgbNEkqO",
+		client_first: "n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		server_first: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		client_final: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		server_final: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	},
+}
+
+func testScram(name string, nonce string) *scramMechanism {
+	scram := newScram(name, &Credentials{Account: "user@example.org", Password: "pencil"})
+	scram.client_nonce = nonce
+	return scram
+}
+
+func TestScramVectors(t *testing.T) {
+	for _, vector := range scramVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			scram := testScram(vector.name, vector.nonce)
+
+			client_first, err := scram.Start()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(client_first) != vector.client_first {
+				t.Errorf("client-first = %q, want %q", client_first, vector.client_first)
+			}
+			client_final, err := scram.Next([]byte(vector.server_first))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(client_final) != vector.client_final {
+				t.Errorf("client-final = %q, want %q", client_final, vector.client_final)
+			}
+			if _, err := scram.Next([]byte(vector.server_final)); err != nil {
+				t.Errorf("server-final: %v", err)
+			}
+			// The success carries nothing more
+			if _, err := scram.Next(nil); err != nil {
+				t.Errorf("success: %v", err)
+			}
+		})
+	}
+}
+
+func TestScramServerErrors(t *testing.T) {
+	vector := scramVectors[0]
+	for _, test := range []struct {
+		name         string
+		server_first string
+		server_final string
+		// The server-first is already refused
+		first_refused bool
+	}{
+		{"tampered signature", vector.server_first, "v=AAF9pqV8S7suAoZWja4dJRkFsKQ=", false},
+		{"success without signature", vector.server_first, "", false},
+		{"error in server-final", vector.server_first, "e=invalid-proof", false},
+		{"foreign nonce", "r=3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096", "", true},
+		{"nonce not extended", "r=" + vector.nonce + ",s=QSXCR+Q6sek8bf92,i=4096", "", true},
+		{"error in server-first", "e=unknown-user", "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			scram := testScram(vector.name, vector.nonce)
+			if _, err := scram.Start(); err != nil {
+				t.Fatal(err)
+			}
+			_, err := scram.Next([]byte(test.server_first))
+			if test.first_refused {
+				if err == nil {
+					t.Fatal("server-first accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := scram.Next([]byte(test.server_final)); err == nil {
+				t.Error("server-final accepted")
+			}
+		})
+	}
+}
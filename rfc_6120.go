@@ -1,29 +1,146 @@
 package xmpp
 
 import (
+	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"strconv"
+	"strings"
 )
 
 // RFC 6120 # 4.1 — Stream Fundamentals
-type clientIQ struct {
-	XMLName xml.Name `xml:"jabber:client iq"`
-	From    string   `xml:"from,attr,omitempty"`
-	ID      string   `xml:"id,attr"`
-	To      string   `xml:"to,attr,omitempty"`
-	Type    string   `xml:"type,attr"`
-	Query   *query   `xml:"query,omitempty"`
-	Bind    *bind    `xml:"bind,omitempty"`
-	Ping    *ping    `xml:"ping,omitempty"`
+type IQ struct {
+	XMLName xml.Name     `xml:"jabber:client iq"`
+	From    string       `xml:"from,attr,omitempty"`
+	ID      string       `xml:"id,attr"`
+	To      string       `xml:"to,attr,omitempty"`
+	Type    string       `xml:"type,attr"`
+	Query   *query       `xml:"query,omitempty"`
+	Bind    *bind        `xml:"bind,omitempty"`
+	Ping    *ping        `xml:"ping,omitempty"`
+	Error   *StanzaError `xml:"error,omitempty"`
+	Payload []Extension  `xml:",any"` // Any other child element
+}
+
+// Extension is an arbitrary child element of a stanza
+type Extension struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+func (e *Extension) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	e.XMLName = start.Name
+	e.Attrs = nil
+	for _, attr := range start.Attr {
+		// Namespace declarations are rebuilt from XMLName when marshaling
+		if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+			continue
+		}
+		e.Attrs = append(e.Attrs, attr)
+	}
+	var raw struct {
+		Inner []byte `xml:",innerxml"`
+	}
+	if err := d.DecodeElement(&raw, &start); err != nil {
+		return err
+	}
+	e.Inner = raw.Inner
+	return nil
+}
+
+// RFC 6120 # 8.2.1 — Message Stanza
+// RFC 6121 # 5.2 — Message Syntax
+type Message struct {
+	XMLName    xml.Name     `xml:"jabber:client message"`
+	From       string       `xml:"from,attr,omitempty"`
+	ID         string       `xml:"id,attr,omitempty"`
+	To         string       `xml:"to,attr,omitempty"`
+	Type       string       `xml:"type,attr,omitempty"` // chat, error, groupchat, headline or normal
+	Lang       string       `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Subject    string       `xml:"subject,omitempty"`
+	Body       string       `xml:"body,omitempty"`
+	Thread     string       `xml:"thread,omitempty"`
+	Error      *StanzaError `xml:"error,omitempty"`
+	Extensions []Extension  `xml:",any"`
+}
+
+// RFC 6120 # 8.2.2 — Presence Stanza
+// RFC 6121 # 4.7 — Presence Syntax
+type Presence struct {
+	XMLName    xml.Name     `xml:"jabber:client presence"`
+	From       string       `xml:"from,attr,omitempty"`
+	ID         string       `xml:"id,attr,omitempty"`
+	To         string       `xml:"to,attr,omitempty"`
+	Type       string       `xml:"type,attr,omitempty"` // Empty when available
+	Show       string       `xml:"show,omitempty"`      // away, chat, dnd or xa
+	Status     string       `xml:"status,omitempty"`
+	Priority   int8         `xml:"priority,omitempty"`
+	Caps       *Caps        `xml:"c,omitempty"` // XEP 0115
+	Error      *StanzaError `xml:"error,omitempty"`
+	Extensions []Extension  `xml:",any"`
+}
+
+// Name of the child element carried by the IQ
+func (iq *IQ) payloadName() xml.Name {
+	switch {
+	case iq.Query != nil:
+		return iq.Query.XMLName
+	case iq.Bind != nil:
+		return xml.Name{Space: nsBind, Local: "bind"}
+	case iq.Ping != nil:
+		return xml.Name{Space: nsPing, Local: "ping"}
+	case len(iq.Payload) > 0:
+		return iq.Payload[0].XMLName
+	}
+	return xml.Name{}
+}
+
+// Result builds the empty result answering an IQ get or set
+func (iq *IQ) Result() *IQ {
+	return &IQ{
+		Type: "result",
+		ID:   iq.ID,
+		To:   iq.From,
+	}
+}
+
+// ErrorResult builds the error answering an IQ get or set
+func (iq *IQ) ErrorResult(stanza_error *StanzaError) *IQ {
+	return &IQ{
+		Type:  "error",
+		ID:    iq.ID,
+		To:    iq.From,
+		Error: stanza_error,
+	}
+}
+
+// Send marshals a stanza and queues it for the server
+func (xmpp *XMPPConnection) Send(ctx context.Context, stanza interface{}) error {
+	output, err := xml.Marshal(stanza)
+	if err != nil {
+		return err
+	}
+	return xmpp.send(ctx, string(output))
 }
 
 type query struct {
 	XMLName    xml.Name
+	Node       string        `xml:"node,attr,omitempty"` // XEP 0030
+	Ver        *string       `xml:"ver,attr,omitempty"`  // RFC 6121 # 2.6
 	Identities [](*Identity) `xml:"identity,omitempty"`
 	Features   [](*Feature)  `xml:"feature,omitempty"`
 	Items      [](*Item)     `xml:"item,omitempty"`
+
+	// XEP 0077 — In-Band Registration
+	Instructions string      `xml:"instructions,omitempty"`
+	Registered   *struct{}   `xml:"registered"`
+	Remove       *struct{}   `xml:"remove"`
+	Form         *DataForm   `xml:"jabber:x:data x"`
+	Fields       []Extension `xml:",any"`
 }
 
 // RFC 6120 # 4.3.2 — Stream features
@@ -33,10 +150,15 @@ type streamFeatures struct {
 	StartTLS   *tlsStartTLS      `xml:"starttls"`
 	Mechanisms *saslMechanisms   `xml:"mechanisms"`
 	Bind       *bind             `xml:"bind"`
-	Sms        [](*streamMgmtSm) `xml:"sm"`  // XEP 0198
-	Caps       *Caps             `xml:"c"`   // XEP 0115
-	Ver        *Ver              `xml:"ver"` // RFC 6121
-	Csi        *Csi              `xml:"csi"` // XEP 0352
+	Sms        [](*streamMgmtSm) `xml:"sm"`       // XEP 0198
+	Caps       *Caps             `xml:"c"`        // XEP 0115
+	Ver        *Ver              `xml:"ver"`      // RFC 6121
+	Sub        *PreApproval      `xml:"sub"`      // RFC 6121
+	Csi        *Csi              `xml:"csi"`      // XEP 0352
+	Register   *registerFeature  `xml:"register"` // XEP 0077
+
+	Authentication *sasl2Authentication `xml:"urn:xmpp:sasl:2 authentication"`          // XEP 0388
+	ChannelBinding *saslChannelBinding  `xml:"urn:xmpp:sasl-cb:0 sasl-channel-binding"` // XEP 0440
 }
 
 // RFC 6120  # 4.7 — Stream Attributes
@@ -60,6 +182,10 @@ type tlsProceed struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-tls proceed"`
 }
 
+type tlsFailure struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-tls failure"`
+}
+
 // RFC 6120  # 6.4.1 — Exchange of Stream Headers and Stream Features
 type saslMechanisms struct {
 	XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms"`
@@ -73,6 +199,17 @@ type saslAuth struct {
 	Mechanism string   `xml:"mechanism,attr"`
 }
 
+// RFC 6120 # 6.4.3 — Challenge-Response Sequence
+type saslChallenge struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl challenge"`
+	Data    string   `xml:",chardata"`
+}
+
+type saslResponse struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl response"`
+	Data    string   `xml:",chardata"`
+}
+
 // RFC 6120 # 6.4.4 — Abort
 type saslAbort struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl abort"`
@@ -88,6 +225,144 @@ type saslFailure struct {
 // RFC 6120 # 6.4.6 — Success
 type saslSuccess struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl success"`
+	Data    string   `xml:",chardata"` // Additional data with success
+}
+
+// RFC 6120 # 8.3 — Stanza Errors
+type StanzaError struct {
+	XMLName   xml.Name `xml:"error"`
+	Type      string   `xml:"type,attr"`
+	By        string   `xml:"by,attr,omitempty"`
+	Condition string   `xml:"-"` // Defined condition, e.g. "item-not-found"
+	Text      string   `xml:"-"`
+}
+
+type stanzaError struct {
+	XMLName  xml.Name    `xml:"error"`
+	Type     string      `xml:"type,attr"`
+	By       string      `xml:"by,attr,omitempty"`
+	Elements []Extension `xml:",any"`
+}
+
+func (e *StanzaError) Error() string {
+	msg := "xmpp: " + e.Type + " error: " + e.Condition
+	if e.Text != "" {
+		msg += ": " + e.Text
+	}
+	return msg
+}
+
+func (e *StanzaError) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	raw := stanzaError{Type: e.Type, By: e.By}
+	raw.Elements = append(raw.Elements, Extension{
+		XMLName: xml.Name{Space: nsStanzas, Local: e.Condition},
+	})
+	if e.Text != "" {
+		var text bytes.Buffer
+		xml.EscapeText(&text, []byte(e.Text))
+		raw.Elements = append(raw.Elements, Extension{
+			XMLName: xml.Name{Space: nsStanzas, Local: "text"},
+			Inner:   text.Bytes(),
+		})
+	}
+	return enc.EncodeElement(raw, start)
+}
+
+func (e *StanzaError) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	e.XMLName = start.Name
+	for _, attr := range start.Attr {
+		switch attr.Name.Local {
+		case "type":
+			e.Type = attr.Value
+		case "by":
+			e.By = attr.Value
+		}
+	}
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if t.Name.Space != nsStanzas {
+				// Application-specific condition
+				if err := d.Skip(); err != nil {
+					return err
+				}
+			} else if t.Name.Local == "text" {
+				if err := d.DecodeElement(&e.Text, &t); err != nil {
+					return err
+				}
+			} else {
+				e.Condition = t.Name.Local
+				if err := d.Skip(); err != nil {
+					return err
+				}
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// SendIQ sends an IQ get or set and waits for the matching result. An IQ of
+// type error is returned along with its *StanzaError.
+func (xmpp *XMPPConnection) SendIQ(ctx context.Context, iq *IQ) (*IQ, error) {
+	if iq.ID == "" {
+		iq.ID = strconv.FormatUint(uint64(get_cookie()), 10)
+	}
+	output, err := xml.Marshal(iq)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, xmpp.config.requestTimeout())
+		defer cancel()
+	}
+
+	response := make(chan *IQ, 1)
+	xmpp.pendingLock.Lock()
+	xmpp.pending[iq.ID] = response
+	xmpp.pendingLock.Unlock()
+	defer func() {
+		xmpp.pendingLock.Lock()
+		delete(xmpp.pending, iq.ID)
+		xmpp.pendingLock.Unlock()
+	}()
+
+	if err := xmpp.send(ctx, string(output)); err != nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-response:
+		if result.Type == "error" {
+			if result.Error == nil {
+				result.Error = &StanzaError{Type: "cancel", Condition: "undefined-condition"}
+			}
+			return result, result.Error
+		}
+		return result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-xmpp.done:
+		return nil, xmpp.closeErr()
+	}
+}
+
+// Hand an IQ result or error to the SendIQ call waiting for it
+func (xmpp *XMPPConnection) deliverIQ(iq *IQ) bool {
+	xmpp.pendingLock.Lock()
+	response, ok := xmpp.pending[iq.ID]
+	delete(xmpp.pending, iq.ID)
+	xmpp.pendingLock.Unlock()
+	if ok {
+		response <- iq
+	}
+	return ok
 }
 
 // RFC 6120  # 9.1.3 — Resource Binding
@@ -97,105 +372,246 @@ type bind struct {
 	Jid      string   `xml:"jid,omitempty"`
 }
 
-func (xmpp *XMPPConnection) Bind(resource string) {
+// RFC 6120 # 7 — Resource Binding, an empty resource lets the server pick
+// one. The full JID assigned by the server is returned.
+func (xmpp *XMPPConnection) Bind(ctx context.Context, resource string) (string, error) {
 	id_bind := strconv.FormatUint(uint64(get_cookie()), 10)
 	bind := &bind{Resource: resource}
-	iq_bind := &clientIQ{
+	iq_bind := &IQ{
 		Type: "set",
 		ID:   id_bind,
 		Bind: bind,
 	}
 	output, _ := xml.Marshal(iq_bind)
 
-	logrus.WithFields(logrus.Fields{
+	xmpp.log.WithFields(logrus.Fields{
 		"resource": resource,
 		"id":       id_bind,
 	}).Info("Binding to resource")
 
-	xmpp.outgoing <- string(output)
-	iq_response := <-xmpp.incoming
+	if err := xmpp.send(ctx, string(output)); err != nil {
+		return "", &BindError{Resource: resource, Err: err}
+	}
+	iq_response, err := xmpp.receive(ctx)
+	if err != nil {
+		return "", &BindError{Resource: resource, Err: err}
+	}
 
 	switch t := iq_response.Interface.(type) {
-	case *clientIQ:
-		if t.ID == id_bind {
-			logrus.WithFields(logrus.Fields{
+	case *IQ:
+		if t.ID == id_bind && t.Type == "result" && t.Bind != nil {
+			xmpp.log.WithFields(logrus.Fields{
 				"resource": resource,
 				"jid":      t.Bind.Jid,
 				"id":       t.ID,
 			}).Info("Bound")
 			xmpp.State.Jid = t.Bind.Jid
 			xmpp.State.Resource = resource
+			if i := strings.Index(t.Bind.Jid, "/"); i >= 0 {
+				xmpp.State.Resource = t.Bind.Jid[i+1:]
+			}
+			return t.Bind.Jid, nil
+		}
+		// RFC 6120 # 7.6.2 — conflict, not-allowed, resource-constraint...
+		if t.ID == id_bind && t.Type == "error" {
+			if t.Error == nil {
+				t.Error = &StanzaError{Type: "cancel", Condition: "undefined-condition"}
+			}
+			return "", &BindError{Resource: resource, Err: t.Error}
 		}
 	}
+	return "", &BindError{Resource: resource, Err: ErrNoBind}
 }
 
-func (xmpp *XMPPConnection) StartStream(domain string) {
+// RFC 6120 # 4.2 — Opening a Stream, then wait for the features. The reads
+// are abandoned once the context is done.
+func (xmpp *XMPPConnection) StartStream(ctx context.Context, domain string) error {
 	// Stream request
 	stream_request := fmt.Sprintf("<?xml version='1.0'?>"+
 		"<stream:stream to='%s' xmlns='%s'"+
 		" xmlns:stream='%s' version='1.0'>",
 		domain, nsClient, nsStream)
 
-	logrus.Info("Send stream request")
-	xmpp.outgoing <- stream_request
+	xmpp.log.Info("Send stream request")
+	if err := xmpp.send(ctx, stream_request); err != nil {
+		return &StreamError{Err: err}
+	}
 
 	// <stream>
-	xmpp.NextElement()
+	stream := xmpp.nextElement(ctx)
+	if stream.Error != nil {
+		return &StreamError{Err: stream.Error}
+	}
 
 	// <features>
-	xmpp.NextElement()
+	features := xmpp.nextElement(ctx)
+	if features.Error != nil {
+		return &StreamError{Err: features.Error}
+	}
+	switch t := features.Interface.(type) {
+	case *streamFeatures:
+		xmpp.features = t
+	default:
+		return &StreamError{Err: errors.New("expected stream features")}
+	}
+	return nil
 }
 
-func (xmpp *XMPPConnection) AuthenticateUser(account string, password string, domain string) {
-	hash := create_user_hash(account, password)
-	auth := &saslAuth{Mechanism: "PLAIN", Auth: string(hash)}
-	output, _ := xml.Marshal(auth)
+// Authenticate with SASL 2 when the server offers it, SASL otherwise
+func (xmpp *XMPPConnection) AuthenticateUser(ctx context.Context, account string, password string, domain string) error {
+	if xmpp.features != nil && xmpp.features.Authentication != nil {
+		offered := xmpp.features.Authentication.Mechanism
+		credentials := xmpp.credentials(account, password, domain, offered)
 
-	logrus.WithFields(logrus.Fields{
-		"account": account,
-	}).Info("Authentication")
+		// XEP 0484 — log in with the token, the password if it is refused
+		if mechanism := xmpp.fastMechanism(credentials); mechanism != nil {
+			err := xmpp.authenticateSasl2(ctx, mechanism, credentials)
+			var auth_error *AuthError
+			if !errors.As(err, &auth_error) || auth_error.Condition == "" {
+				return err
+			}
+			xmpp.fastRefused()
+			if password == "" {
+				return err
+			}
+		}
 
-	xmpp.outgoing <- string(output)
-	auth_result := <-xmpp.incoming
+		mechanism, err := xmpp.selectMechanism(credentials, offered)
+		if err == nil {
+			return xmpp.authenticateSasl2(ctx, mechanism, credentials)
+		}
+		xmpp.log.Info("[XEP 0388] No usable mechanism, falling back to SASL")
+	}
 
-	switch t := auth_result.Interface.(type) {
-	case *saslSuccess:
-		logrus.Info("Authenticated, request new stream")
+	var offered []string
+	if xmpp.features != nil && xmpp.features.Mechanisms != nil {
+		offered = xmpp.features.Mechanisms.Mechanism
+	}
+	mechanism, err := xmpp.selectMechanism(xmpp.credentials(account, password, domain, offered), offered)
+	if err != nil {
+		return &AuthError{Err: err}
+	}
+	mechanism_name := mechanism.Name()
 
-		stream_request := fmt.Sprintf("<?xml version='1.0'?>"+
-			"<stream:stream to='%s' xmlns='%s'"+
-			" xmlns:stream='%s' version='1.0'>",
-			domain, nsClient, nsStream)
+	xmpp.log.WithFields(logrus.Fields{
+		"account":   account,
+		"mechanism": mechanism_name,
+	}).Info("Authentication")
 
-		xmpp.outgoing <- stream_request
+	initial, err := mechanism.Start()
+	if err != nil {
+		return &AuthError{Mechanism: mechanism_name, Err: err}
+	}
+	auth := &saslAuth{Mechanism: mechanism_name, Auth: sasl_encode(initial)}
+	output, _ := xml.Marshal(auth)
+	if err := xmpp.send(ctx, string(output)); err != nil {
+		return &AuthError{Mechanism: mechanism_name, Err: err}
+	}
 
-		// <stream>
-		<-xmpp.incoming
+	for {
+		auth_result, err := xmpp.receive(ctx)
+		if err != nil {
+			return &AuthError{Mechanism: mechanism_name, Err: err}
+		}
 
-		// <features>
-		features := <-xmpp.incoming
-		switch t := features.Interface.(type) {
-		case *streamFeatures:
-			xmpp.State.Roster = &RosterConfig{}
-			if t.Ver != nil && t.Ver.XMLName.Space == nsRosterVer {
-				xmpp.State.Roster.version_supported = true
+		switch t := auth_result.Interface.(type) {
+		case *saslChallenge:
+			challenge, err := sasl_decode(t.Data)
+			if err == nil {
+				var response []byte
+				response, err = mechanism.Next(challenge)
+				if err == nil {
+					output, _ := xml.Marshal(&saslResponse{Data: sasl_encode(response)})
+					err = xmpp.send(ctx, string(output))
+				}
+			}
+			if err != nil {
+				output, _ := xml.Marshal(&saslAbort{})
+				xmpp.send(ctx, string(output))
+				return &AuthError{Mechanism: mechanism_name, Err: err}
 			}
 
-			for _, attr := range t.Sms {
-				if attr.XMLName.Space == nsStreamMgmt {
-					xmpp.State.Sm = &StreamManagementConfig{}
-				}
-				if attr.XMLName.Space == nsStreamMgmt {
-					xmpp.State.Sm.version = 3
-				}
+		case *saslSuccess:
+			// Additional data with success is the last server message
+			data, err := sasl_decode(t.Data)
+			if err == nil {
+				_, err = mechanism.Next(data)
+			}
+			if err != nil {
+				return &AuthError{Mechanism: mechanism_name, Err: err}
+			}
+			xmpp.State.Auth = &AuthConfig{
+				Mechanism:      mechanism_name,
+				AdditionalData: data,
+			}
+			xmpp.log.Info("Authenticated, request new stream")
+			return xmpp.restartStream(ctx, domain)
+
+		case *saslFailure:
+			xmpp.log.Error("Authentication failure : " + t.Text)
+			return &AuthError{
+				Mechanism: mechanism_name,
+				Condition: t.Any.Local,
+				Text:      t.Text,
+				Err:       saslConditions[t.Any.Local],
 			}
+		default:
+			xmpp.log.Error("Authentication failure : XML error")
+			return &AuthError{Mechanism: mechanism_name, Err: errors.New("unexpected response")}
 		}
+	}
+}
+
+// RFC 6120 # 6.4.6 — Success, the stream is restarted
+func (xmpp *XMPPConnection) restartStream(ctx context.Context, domain string) error {
+	stream_request := fmt.Sprintf("<?xml version='1.0'?>"+
+		"<stream:stream to='%s' xmlns='%s'"+
+		" xmlns:stream='%s' version='1.0'>",
+		domain, nsClient, nsStream)
 
-	case *saslFailure:
-		logrus.Error("Authentication failure : " + t.Text)
-		xmpp.Close()
+	if err := xmpp.send(ctx, stream_request); err != nil {
+		return &StreamError{Err: err}
+	}
+
+	// <stream>
+	if _, err := xmpp.receive(ctx); err != nil {
+		return &StreamError{Err: err}
+	}
+	return xmpp.awaitFeatures(ctx)
+}
+
+// Read the features offered once authenticated
+func (xmpp *XMPPConnection) awaitFeatures(ctx context.Context) error {
+	features, err := xmpp.receive(ctx)
+	if err != nil {
+		return &StreamError{Err: err}
+	}
+	switch t := features.Interface.(type) {
+	case *streamFeatures:
+		xmpp.processFeatures(t)
 	default:
-		logrus.Error("Authentication failure : XML error")
-		xmpp.Close()
+		return &StreamError{Err: errors.New("expected stream features")}
+	}
+	return nil
+}
+
+// Record the features offered once authenticated
+func (xmpp *XMPPConnection) processFeatures(features *streamFeatures) {
+	xmpp.features = features
+	xmpp.State.Roster = &RosterConfig{store: xmpp.config.rosterStore()}
+	if features.Ver != nil && features.Ver.XMLName.Space == nsRosterVer {
+		xmpp.State.Roster.version_supported = true
+	}
+	if features.Sub != nil && features.Sub.XMLName.Space == nsPreApproval {
+		xmpp.State.Roster.pre_approval_supported = true
+	}
+
+	for _, attr := range features.Sms {
+		if attr.XMLName.Space == nsStreamMgmt {
+			xmpp.State.Sm = &StreamManagementConfig{}
+		}
+		if attr.XMLName.Space == nsStreamMgmt {
+			xmpp.State.Sm.version = 3
+		}
 	}
 }
@@ -0,0 +1,254 @@
+package xmpp
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connection without a socket, answer builds the reply to each element sent:
+// nil for none, a []interface{} for several
+func testConnection(answer func(data string) interface{}) *XMPPConnection {
+	xmpp := &XMPPConnection{
+		incoming: make(chan incomingResult),
+		outgoing: make(chan outgoingData),
+		done:     make(chan struct{}),
+		pending:  make(map[string]chan *IQ),
+		log:      logrus.New(),
+	}
+	// Replies are queued, the handler of one reply may send before the
+	// next is delivered
+	replies := make(chan interface{}, 64)
+	go func() {
+		for {
+			select {
+			case out := <-xmpp.outgoing:
+				reply := answer(out.data)
+				list, ok := reply.([]interface{})
+				if !ok {
+					list = []interface{}{reply}
+				}
+				for _, reply := range list {
+					if reply != nil {
+						replies <- reply
+					}
+				}
+			case <-xmpp.done:
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case reply := <-replies:
+				select {
+				case xmpp.incoming <- incomingResult{Interface: reply}:
+				case <-xmpp.done:
+					return
+				}
+			case <-xmpp.done:
+				return
+			}
+		}
+	}()
+	return xmpp
+}
+
+// Error answer to the IQ sent
+func testIQError(data string, stanza_error *StanzaError) interface{} {
+	var iq IQ
+	xml.Unmarshal([]byte(data), &iq)
+	return &IQ{ID: iq.ID, Type: "error", Error: stanza_error}
+}
+
+func TestBindError(t *testing.T) {
+	for _, condition := range []string{"conflict", "not-allowed", "resource-constraint"} {
+		t.Run(condition, func(t *testing.T) {
+			xmpp := testConnection(func(data string) interface{} {
+				return testIQError(data, &StanzaError{Type: "cancel", Condition: condition})
+			})
+			defer close(xmpp.done)
+
+			_, err := xmpp.Bind(context.Background(), "res")
+			var bind_error *BindError
+			if !errors.As(err, &bind_error) {
+				t.Fatalf("err = %v, want *BindError", err)
+			}
+			var stanza_error *StanzaError
+			if !errors.As(err, &stanza_error) || stanza_error.Condition != condition {
+				t.Errorf("err = %v, want the %s stanza error", err, condition)
+			}
+		})
+	}
+}
+
+func TestBindErrorRetryable(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"conflict", &StanzaError{Type: "cancel", Condition: "conflict"}, false},
+		{"not allowed", &StanzaError{Type: "cancel", Condition: "not-allowed"}, false},
+		{"resource constraint", &StanzaError{Type: "wait", Condition: "resource-constraint"}, true},
+		{"wait", &StanzaError{Type: "wait", Condition: "internal-server-error"}, true},
+		{"no JID", ErrNoBind, false},
+		{"closed", ErrClosed, true},
+		{"timeout", context.DeadlineExceeded, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := &BindError{Resource: "res", Err: test.err}
+			if got := Retryable(err); got != test.want {
+				t.Errorf("Retryable(%v) = %v, want %v", err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestStartStreamContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	// The server reads the stream header and never answers
+	go io.Copy(io.Discard, server)
+
+	xmpp := &XMPPConnection{
+		outgoing: make(chan outgoingData),
+		done:     make(chan struct{}),
+		reader:   xml.NewDecoder(client),
+		writer:   bufio.NewWriter(client),
+		conn:     client,
+		log:      logrus.New(),
+	}
+	go xmpp.Write()
+	defer xmpp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() { result <- xmpp.StartStream(ctx, "example.org") }()
+
+	select {
+	case err := <-result:
+		var stream_error *StreamError
+		if !errors.As(err, &stream_error) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want a stream error on the deadline", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartStream ignored the context")
+	}
+}
+
+// Answer to a disco#info get, echoing its id as the node
+func testIQResult(data string) *IQ {
+	var iq IQ
+	xml.Unmarshal([]byte(data), &iq)
+	return &IQ{ID: iq.ID, Type: "result", Query: &query{
+		XMLName: xml.Name{Space: nsDiscoInfo, Local: "query"},
+		Node:    iq.ID,
+	}}
+}
+
+func testDiscoGet() *IQ {
+	return &IQ{Type: "get", To: "example.org", Query: &query{XMLName: xml.Name{Space: nsDiscoInfo, Local: "query"}}}
+}
+
+func TestSendIQConcurrent(t *testing.T) {
+	const requests = 8
+	// Answered all at once, in reverse order
+	var held []interface{}
+	xmpp := testConnection(func(data string) interface{} {
+		held = append([]interface{}{testIQResult(data)}, held...)
+		if len(held) < requests {
+			return nil
+		}
+		return held
+	})
+	defer close(xmpp.done)
+	xmpp.mux = NewMux()
+	go xmpp.Process()
+
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			iq := testDiscoGet()
+			result, err := xmpp.SendIQ(context.Background(), iq)
+			if err == nil && (result.ID != iq.ID || result.Query == nil || result.Query.Node != iq.ID) {
+				err = errors.New("result of another request for " + iq.ID)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSendIQError(t *testing.T) {
+	xmpp := testConnection(func(data string) interface{} {
+		return testIQError(data, &StanzaError{Type: "cancel", Condition: "item-not-found"})
+	})
+	defer close(xmpp.done)
+	xmpp.mux = NewMux()
+	go xmpp.Process()
+
+	result, err := xmpp.SendIQ(context.Background(), testDiscoGet())
+	var stanza_error *StanzaError
+	if !errors.As(err, &stanza_error) || stanza_error.Condition != "item-not-found" {
+		t.Fatalf("err = %v, want the item-not-found stanza error", err)
+	}
+	if result == nil || result.Type != "error" {
+		t.Errorf("result = %+v, want the error IQ", result)
+	}
+}
+
+func TestSendIQTimeout(t *testing.T) {
+	sent := make(chan string, 2)
+	xmpp := testConnection(func(data string) interface{} {
+		sent <- data
+		return nil
+	})
+	defer close(xmpp.done)
+	xmpp.mux = NewMux()
+	go xmpp.Process()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := xmpp.SendIQ(ctx, testDiscoGet())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	xmpp.pendingLock.Lock()
+	pending := len(xmpp.pending)
+	xmpp.pendingLock.Unlock()
+	if pending != 0 {
+		t.Errorf("%d requests still pending", pending)
+	}
+
+	// The late response is dropped, it is not taken for the next one
+	late := testIQResult(<-sent)
+	xmpp.incoming <- incomingResult{Interface: late}
+	if xmpp.deliverIQ(late) {
+		t.Error("late response delivered")
+	}
+	go func() {
+		data := <-sent
+		xmpp.incoming <- incomingResult{Interface: testIQResult(data)}
+	}()
+	iq := testDiscoGet()
+	result, err := xmpp.SendIQ(context.Background(), iq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ID != iq.ID {
+		t.Errorf("result %s, want %s", result.ID, iq.ID)
+	}
+}
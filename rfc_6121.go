@@ -1,68 +1,567 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"strconv"
+	"sync"
 )
 
 type Ver struct {
 	XMLName xml.Name `xml:"urn:xmpp:features:rosterver ver"`
 }
 
+// RFC 6121 # 3.4 — Pre-Approving a Subscription Request
+type PreApproval struct {
+	XMLName xml.Name `xml:"urn:xmpp:features:pre-approval sub"`
+}
+
 type Item struct {
 	XMLName      xml.Name `xml:"item"`
 	Jid          string   `xml:"jid,attr"`
-	Subscription string   `xml:"subscription,attr"`
-	Name         string   `xml:"name,attr"`
-	Group        string   `xml:"group"`
+	Subscription string   `xml:"subscription,attr,omitempty"`
+	Name         string   `xml:"name,attr,omitempty"`
+	Ask          string   `xml:"ask,attr,omitempty"`      // RFC 6121 # 2.1.2.2
+	Approved     bool     `xml:"approved,attr,omitempty"` // RFC 6121 # 2.1.2.1
+	Groups       []string `xml:"group"`
 }
 
 type Contact struct {
-	Name         string `json:"name"`
-	Jid          string `json:"jid"`
-	Group        string `json:"group"`
-	Subscription string `json:"subscription"`
+	Name         string   `json:"name"`
+	Jid          string   `json:"jid"`
+	Groups       []string `json:"groups"`
+	Subscription string   `json:"subscription"`
+	Ask          string   `json:"ask,omitempty"`
+	Approved     bool     `json:"approved,omitempty"`
 }
 
+// RosterConfig is the roster of the session, read it with List or Contact
 type RosterConfig struct {
-	version_supported bool
-	incoming          chan *clientIQ
-	Contacts          []*Contact
+	version_supported      bool
+	pre_approval_supported bool
+	// Replaced by pushes from the Process goroutine, read with List
+	contacts []*Contact
+	// Available resources, by bare JID then full JID
+	presences map[string]map[string]*Presence
+	lock      sync.RWMutex
+	store     RosterStore
+	// Pushes received while the roster is not loaded, applied in order
+	// once it is
+	loaded bool
+	queued []rosterPush
 }
 
-func (xmpp *XMPPConnection) GetRoster() {
-	xmpp.State.Roster.incoming = make(chan *clientIQ)
+type rosterPush struct {
+	item *Item
+	ver  *string
+}
 
+func (xmpp *XMPPConnection) GetRoster(ctx context.Context) error {
+	roster := xmpp.State.Roster
 	query := &query{XMLName: xml.Name{Local: "query", Space: nsRoster}}
-	query_disco_id := strconv.FormatUint(uint64(get_cookie()), 10)
-	query_disco := &clientIQ{
+
+	// Pushes following the result would be overwritten by it, they wait
+	roster.lock.Lock()
+	was_loaded := roster.loaded
+	roster.loaded = false
+	roster.lock.Unlock()
+
+	// RFC 6121 # 2.6.2 — send the stored version, empty to get the whole roster
+	var stored_contacts []*Contact
+	if roster.version_supported {
+		version, contacts, err := roster.store.Load()
+		if err != nil {
+			xmpp.log.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("[RFC 6121] Cannot load stored roster")
+			version, contacts = "", nil
+		}
+		query.Ver = &version
+		stored_contacts = contacts
+	}
+
+	query_roster := &IQ{
 		Type:  "get",
-		ID:    query_disco_id,
 		From:  xmpp.State.Jid,
 		Query: query,
 	}
-	output, _ := xml.Marshal(query_disco)
-
-	logrus.Info("[RFC 6121] Retrieving roster…")
-	xmpp.outgoing <- string(output)
 
-	result := <-xmpp.State.Roster.incoming
-	xmpp.State.Roster.Contacts = make([]*Contact, 0)
+	xmpp.log.Info("[RFC 6121] Retrieving roster…")
+	result, err := xmpp.SendIQ(ctx, query_roster)
+	if err == nil && result.Query == nil && !roster.version_supported {
+		err = errors.New("empty roster result")
+	}
+	if err != nil {
+		// The roster in memory is still complete
+		if was_loaded {
+			xmpp.rosterLoaded(nil, nil)
+		}
+		return err
+	}
+	if result.Query == nil {
+		// RFC 6121 # 2.6.3 — the stored roster is up to date, changes
+		// follow as roster pushes
+		xmpp.log.WithFields(logrus.Fields{
+			"ver": *query.Ver,
+		}).Info("[RFC 6121] Stored roster is up to date")
+		if stored_contacts == nil {
+			stored_contacts = make([]*Contact, 0)
+		}
+		xmpp.rosterLoaded(stored_contacts, nil)
+		return nil
+	}
+	contacts := make([]*Contact, 0)
 
 	for _, item := range result.Query.Items {
-		logrus.WithFields(logrus.Fields{
+		xmpp.log.WithFields(logrus.Fields{
 			"name":         item.Name,
 			"jid":          item.Jid,
-			"group":        item.Group,
+			"groups":       item.Groups,
 			"subscription": item.Subscription,
 		}).Info("[RFC 6121] Found roster item : ")
-		c := &Contact{
-			Name:         item.Name,
-			Jid:          item.Jid,
-			Group:        item.Group,
-			Subscription: item.Subscription,
+		contacts = append(contacts, item.contact())
+	}
+
+	xmpp.rosterLoaded(contacts, result.Query.Ver)
+	return nil
+}
+
+// The roster is complete: apply the pushes queued meanwhile, in order, and
+// store it. Contacts are kept when nil, version is nil when unchanged.
+func (xmpp *XMPPConnection) rosterLoaded(contacts []*Contact, version *string) {
+	roster := xmpp.State.Roster
+	roster.lock.Lock()
+	if contacts != nil {
+		roster.contacts = contacts
+	}
+	for {
+		queued := roster.queued
+		roster.queued = nil
+		if len(queued) == 0 {
+			break
+		}
+		events := make([]RosterEvent, 0, len(queued))
+		for _, push := range queued {
+			events = append(events, roster.apply(push.item))
+			if push.ver != nil {
+				version = push.ver
+			}
+		}
+		// Events are sent unlocked, more pushes may be queued meanwhile
+		roster.lock.Unlock()
+		for _, event := range events {
+			xmpp.rosterEvent(event)
+		}
+		roster.lock.Lock()
+	}
+	if roster.version_supported && version != nil {
+		roster.save(xmpp, *version)
+	}
+	roster.loaded = true
+	roster.lock.Unlock()
+}
+
+// Persist the complete roster, roster.lock must be held
+func (roster *RosterConfig) save(xmpp *XMPPConnection, version string) {
+	if err := roster.store.Save(version, roster.contacts); err != nil {
+		xmpp.log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("[RFC 6121] Cannot store roster")
+	}
+}
+
+func (item *Item) contact() *Contact {
+	return &Contact{
+		Name:         item.Name,
+		Jid:          item.Jid,
+		Groups:       item.Groups,
+		Subscription: item.Subscription,
+		Ask:          item.Ask,
+		Approved:     item.Approved,
+	}
+}
+
+// List returns a copy of the roster, the way to read it while pushes are
+// applied
+func (roster *RosterConfig) List() []*Contact {
+	roster.lock.RLock()
+	defer roster.lock.RUnlock()
+
+	contacts := make([]*Contact, len(roster.contacts))
+	copy(contacts, roster.contacts)
+	return contacts
+}
+
+// Contact returns the roster item of a JID, nil if it is not in the roster
+func (roster *RosterConfig) Contact(jid string) *Contact {
+	roster.lock.RLock()
+	defer roster.lock.RUnlock()
+
+	for _, contact := range roster.contacts {
+		if contact.Jid == bare_jid(jid) {
+			return contact
+		}
+	}
+	return nil
+}
+
+const (
+	RosterAdd    = "add"
+	RosterUpdate = "update"
+	RosterRemove = "remove"
+)
+
+// RosterEvent describes a change of the roster pushed by the server
+type RosterEvent struct {
+	Type    string // RosterAdd, RosterUpdate or RosterRemove
+	Contact *Contact
+}
+
+// Replace, add or remove the contact of a pushed item. Contacts are never
+// modified in place, so previously returned pointers stay consistent.
+// roster.lock must be held.
+func (roster *RosterConfig) apply(item *Item) RosterEvent {
+	contact := item.contact()
+	for i, c := range roster.contacts {
+		if c.Jid != item.Jid {
+			continue
+		}
+		if item.Subscription == "remove" {
+			roster.contacts = append(roster.contacts[:i:i], roster.contacts[i+1:]...)
+			return RosterEvent{Type: RosterRemove, Contact: c}
+		}
+		roster.contacts[i] = contact
+		return RosterEvent{Type: RosterUpdate, Contact: contact}
+	}
+	if item.Subscription == "remove" {
+		return RosterEvent{Type: RosterRemove, Contact: contact}
+	}
+	roster.contacts = append(roster.contacts, contact)
+	return RosterEvent{Type: RosterAdd, Contact: contact}
+}
+
+// RosterEvents returns the changes pushed by the server. Like Messages,
+// events are only queued once RosterEvents has been called.
+func (xmpp *XMPPConnection) RosterEvents() <-chan RosterEvent {
+	xmpp.rosterEventsWanted.Store(true)
+	return xmpp.rosterEvents
+}
+
+// RFC 6121 # 2.1.6 — Roster Push
+func handleRosterPush(xmpp *XMPPConnection, iq *IQ) {
+	// Only our server may push roster changes
+	if iq.From != "" && iq.From != bare_jid(xmpp.State.Jid) {
+		xmpp.log.WithFields(logrus.Fields{
+			"from": iq.From,
+		}).Warn("[RFC 6121] Ignoring roster push from a third party")
+		xmpp.Send(context.Background(), iq.ErrorResult(&StanzaError{
+			Type:      "cancel",
+			Condition: "service-unavailable",
+		}))
+		return
+	}
+	if iq.Query == nil || len(iq.Query.Items) != 1 || xmpp.State.Roster == nil {
+		xmpp.Send(context.Background(), iq.ErrorResult(&StanzaError{
+			Type:      "modify",
+			Condition: "bad-request",
+		}))
+		return
+	}
+	xmpp.Send(context.Background(), iq.Result())
+
+	roster := xmpp.State.Roster
+	item := iq.Query.Items[0]
+	roster.lock.Lock()
+	if !roster.loaded {
+		// A partial roster is never applied nor stored
+		roster.queued = append(roster.queued, rosterPush{item, iq.Query.Ver})
+		roster.lock.Unlock()
+		xmpp.log.WithFields(logrus.Fields{
+			"jid": item.Jid,
+		}).Debug("[RFC 6121] Roster push queued until the roster is loaded")
+		return
+	}
+	event := roster.apply(item)
+	// RFC 6121 # 2.6.3 — every push carries the new roster version
+	if roster.version_supported && iq.Query.Ver != nil {
+		roster.save(xmpp, *iq.Query.Ver)
+	}
+	roster.lock.Unlock()
+
+	xmpp.log.WithFields(logrus.Fields{
+		"jid":          event.Contact.Jid,
+		"subscription": event.Contact.Subscription,
+		"event":        event.Type,
+	}).Info("[RFC 6121] Roster push")
+	xmpp.rosterEvent(event)
+}
+
+// Queue the event when RosterEvents was called
+func (xmpp *XMPPConnection) rosterEvent(event RosterEvent) {
+	if !xmpp.rosterEventsWanted.Load() {
+		return
+	}
+	select {
+	case xmpp.rosterEvents <- event:
+	case <-xmpp.done:
+	}
+}
+
+// Send a roster set and wait for the server, the roster itself is updated by
+// the push that follows
+func (xmpp *XMPPConnection) setRosterItem(ctx context.Context, item *Item) error {
+	query := &query{
+		XMLName: xml.Name{Local: "query", Space: nsRoster},
+		Items:   []*Item{item},
+	}
+	_, err := xmpp.SendIQ(ctx, &IQ{
+		Type:  "set",
+		Query: query,
+	})
+	return err
+}
+
+// RFC 6121 # 2.3 — Adding a Roster Item
+func (xmpp *XMPPConnection) AddContact(ctx context.Context, contact Contact) error {
+	return xmpp.setContact(ctx, contact, "[RFC 6121] Adding contact")
+}
+
+// RFC 6121 # 2.4 — Updating a Roster Item
+// The name and every group are replaced by those of the contact.
+func (xmpp *XMPPConnection) UpdateContact(ctx context.Context, contact Contact) error {
+	return xmpp.setContact(ctx, contact, "[RFC 6121] Updating contact")
+}
+
+// Adding and updating are the same roster set, the item replaces any other
+func (xmpp *XMPPConnection) setContact(ctx context.Context, contact Contact, message string) error {
+	xmpp.log.WithFields(logrus.Fields{
+		"jid":    contact.Jid,
+		"name":   contact.Name,
+		"groups": contact.Groups,
+	}).Info(message)
+	return xmpp.setRosterItem(ctx, &Item{
+		Jid:    bare_jid(contact.Jid),
+		Name:   contact.Name,
+		Groups: contact.Groups,
+	})
+}
+
+// RFC 6121 # 2.5 — Deleting a Roster Item
+func (xmpp *XMPPConnection) RemoveContact(ctx context.Context, jid string) error {
+	xmpp.log.WithFields(logrus.Fields{
+		"jid": jid,
+	}).Info("[RFC 6121] Removing contact")
+	return xmpp.setRosterItem(ctx, &Item{
+		Jid:          bare_jid(jid),
+		Subscription: "remove",
+	})
+}
+
+// RFC 6121 # 5.1 — One-to-One Chat Sessions
+func (xmpp *XMPPConnection) SendMessage(ctx context.Context, message Message) error {
+	if message.ID == "" {
+		message.ID = strconv.FormatUint(uint64(get_cookie()), 10)
+	}
+
+	xmpp.log.WithFields(logrus.Fields{
+		"to":   message.To,
+		"id":   message.ID,
+		"type": message.Type,
+	}).Info("[RFC 6121] Sending message")
+	return xmpp.Send(ctx, &message)
+}
+
+// Messages returns the incoming messages not caught by a more specific Mux
+// handler. Messages are only queued once Messages has been called, and the
+// channel must then be drained or every incoming stanza will be held up.
+func (xmpp *XMPPConnection) Messages() <-chan *Message {
+	xmpp.messagesWanted.Store(true)
+	return xmpp.messages
+}
+
+// RFC 6121 # 5.3 — Receiving a Message
+func handleMessage(xmpp *XMPPConnection, message *Message) {
+	xmpp.log.WithFields(logrus.Fields{
+		"from": message.From,
+		"id":   message.ID,
+		"type": message.Type,
+	}).Info("[RFC 6121] Received message")
+
+	if !xmpp.messagesWanted.Load() {
+		return
+	}
+	select {
+	case xmpp.messages <- message:
+	case <-xmpp.done:
+	}
+}
+
+// RFC 6121 # 4.2 — Initial Presence
+// RFC 6121 # 4.4 — Presence Broadcast
+func (xmpp *XMPPConnection) SendPresence(ctx context.Context, presence Presence) error {
+	xmpp.log.WithFields(logrus.Fields{
+		"to":     presence.To,
+		"type":   presence.Type,
+		"show":   presence.Show,
+		"status": presence.Status,
+	}).Info("[RFC 6121] Sending presence")
+	return xmpp.Send(ctx, &presence)
+}
+
+// RFC 6121 # 4.4.2 — Server Processing of Subsequent Outbound Presence
+func (roster *RosterConfig) trackPresence(presence *Presence) {
+	bare := bare_jid(presence.From)
+
+	roster.lock.Lock()
+	defer roster.lock.Unlock()
+	if roster.presences == nil {
+		roster.presences = make(map[string]map[string]*Presence)
+	}
+
+	switch presence.Type {
+	case "":
+		if roster.presences[bare] == nil {
+			roster.presences[bare] = make(map[string]*Presence)
+		}
+		roster.presences[bare][presence.From] = presence
+	case "unavailable":
+		delete(roster.presences[bare], presence.From)
+		if len(roster.presences[bare]) == 0 {
+			delete(roster.presences, bare)
+		}
+	case "error":
+		// RFC 6121 # 4.6.3 — the contact is considered offline
+		delete(roster.presences, bare)
+	}
+}
+
+// Presences returns the available resources of a contact
+func (roster *RosterConfig) Presences(jid string) []*Presence {
+	roster.lock.RLock()
+	defer roster.lock.RUnlock()
+
+	presences := make([]*Presence, 0, len(roster.presences[bare_jid(jid)]))
+	for _, presence := range roster.presences[bare_jid(jid)] {
+		presences = append(presences, presence)
+	}
+	return presences
+}
+
+// Available reports whether a contact, or a given full JID, is online
+func (roster *RosterConfig) Available(jid string) bool {
+	roster.lock.RLock()
+	defer roster.lock.RUnlock()
+
+	resources := roster.presences[bare_jid(jid)]
+	if jid == bare_jid(jid) {
+		return len(resources) > 0
+	}
+	_, ok := resources[jid]
+	return ok
+}
+
+// SubscriptionDecision is the answer of a SubscriptionPolicy
+type SubscriptionDecision int
+
+const (
+	// Leave the request to SubscriptionRequests
+	SubscriptionAsk SubscriptionDecision = iota
+	SubscriptionApprove
+	SubscriptionDeny
+)
+
+// SubscriptionPolicy decides what to do with an incoming subscription
+// request. It is called from the Process goroutine.
+type SubscriptionPolicy func(xmpp *XMPPConnection, request *Presence) SubscriptionDecision
+
+// ApproveRosterMembers approves requests from contacts already in the roster
+func ApproveRosterMembers(xmpp *XMPPConnection, request *Presence) SubscriptionDecision {
+	if xmpp.State.Roster != nil && xmpp.State.Roster.Contact(request.From) != nil {
+		return SubscriptionApprove
+	}
+	return SubscriptionAsk
+}
+
+func (xmpp *XMPPConnection) sendSubscription(ctx context.Context, jid string, subscription_type string) error {
+	xmpp.log.WithFields(logrus.Fields{
+		"jid":  jid,
+		"type": subscription_type,
+	}).Info("[RFC 6121] Subscription")
+	return xmpp.Send(ctx, &Presence{
+		To:   bare_jid(jid),
+		ID:   strconv.FormatUint(uint64(get_cookie()), 10),
+		Type: subscription_type,
+	})
+}
+
+// RFC 6121 # 3.1.1 — Client Generation of Outbound Subscription Request
+func (xmpp *XMPPConnection) Subscribe(ctx context.Context, jid string) error {
+	return xmpp.sendSubscription(ctx, jid, "subscribe")
+}
+
+// RFC 6121 # 3.1.5 — Client Processing of Inbound Subscription Request
+func (xmpp *XMPPConnection) ApproveSubscription(ctx context.Context, jid string) error {
+	return xmpp.sendSubscription(ctx, jid, "subscribed")
+}
+
+// RFC 6121 # 3.1.5 — Client Processing of Inbound Subscription Request
+func (xmpp *XMPPConnection) DenySubscription(ctx context.Context, jid string) error {
+	return xmpp.sendSubscription(ctx, jid, "unsubscribed")
+}
+
+// RFC 6121 # 3.2 — Canceling a Subscription
+// The contact no longer receives our presence.
+func (xmpp *XMPPConnection) CancelSubscription(ctx context.Context, jid string) error {
+	return xmpp.sendSubscription(ctx, jid, "unsubscribed")
+}
+
+// RFC 6121 # 3.3 — Unsubscribing
+// We no longer receive the presence of the contact.
+func (xmpp *XMPPConnection) Unsubscribe(ctx context.Context, jid string) error {
+	return xmpp.sendSubscription(ctx, jid, "unsubscribe")
+}
+
+// RFC 6121 # 3.4 — Pre-Approving a Subscription Request
+func (xmpp *XMPPConnection) PreApproveSubscription(ctx context.Context, jid string) error {
+	if xmpp.State.Roster == nil || !xmpp.State.Roster.pre_approval_supported {
+		return ErrPreApprovalUnsupported
+	}
+	return xmpp.sendSubscription(ctx, jid, "subscribed")
+}
+
+// SubscriptionRequests returns the subscription requests left undecided by
+// the SubscriptionPolicy. Like Messages, requests are only queued once
+// SubscriptionRequests has been called.
+func (xmpp *XMPPConnection) SubscriptionRequests() <-chan *Presence {
+	xmpp.subscriptionsWanted.Store(true)
+	return xmpp.subscriptions
+}
+
+// RFC 6121 # 3.1.3 — Server Processing of Inbound Subscription Request
+func (xmpp *XMPPConnection) handleSubscription(request *Presence) {
+	xmpp.log.WithFields(logrus.Fields{
+		"from": request.From,
+	}).Info("[RFC 6121] Subscription request")
+
+	decision := SubscriptionAsk
+	if xmpp.config.SubscriptionPolicy != nil {
+		decision = xmpp.config.SubscriptionPolicy(xmpp, request)
+	}
+
+	switch decision {
+	case SubscriptionApprove:
+		xmpp.ApproveSubscription(context.Background(), request.From)
+	case SubscriptionDeny:
+		xmpp.DenySubscription(context.Background(), request.From)
+	default:
+		if !xmpp.subscriptionsWanted.Load() {
+			return
+		}
+		select {
+		case xmpp.subscriptions <- request:
+		case <-xmpp.done:
 		}
-		xmpp.State.Roster.Contacts = append(xmpp.State.Roster.Contacts, c)
 	}
 }
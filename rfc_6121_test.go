@@ -0,0 +1,421 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Poll until the condition holds
+func testEventually(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Connection processing the stanzas it receives, with a versioned roster.
+// replies answers the roster get, other IQs sent go to sent when not nil.
+func testRosterConnection(store RosterStore, replies func(id string) []interface{}, sent chan<- *IQ) *XMPPConnection {
+	xmpp := testConnection(func(data string) interface{} {
+		var iq IQ
+		if xml.Unmarshal([]byte(data), &iq) != nil {
+			return nil
+		}
+		if iq.Type == "get" {
+			return replies(iq.ID)
+		}
+		if sent != nil {
+			sent <- &iq
+		}
+		return nil
+	})
+	xmpp.mux = NewMux()
+	xmpp.mux.handleIQDefault("set", xml.Name{Space: nsRoster, Local: "query"}, handleRosterPush)
+	xmpp.rosterEvents = make(chan RosterEvent, 8)
+	xmpp.State.Jid = "user@example.org/res"
+	xmpp.State.Roster = &RosterConfig{version_supported: true, store: store}
+	go xmpp.Process()
+	return xmpp
+}
+
+func testRosterPush(id string, ver string, jid string) *IQ {
+	return &IQ{Type: "set", ID: id, Query: &query{
+		XMLName: xml.Name{Space: nsRoster, Local: "query"},
+		Ver:     &ver,
+		Items:   []*Item{{Jid: jid, Subscription: "both"}},
+	}}
+}
+
+func testRosterResult(id string, ver string, jids ...string) *IQ {
+	if ver == "" {
+		// RFC 6121 # 2.6.3 — the stored roster is up to date
+		return &IQ{Type: "result", ID: id}
+	}
+	result := &IQ{Type: "result", ID: id, Query: &query{
+		XMLName: xml.Name{Space: nsRoster, Local: "query"},
+		Ver:     &ver,
+	}}
+	for _, jid := range jids {
+		result.Query.Items = append(result.Query.Items, &Item{Jid: jid, Subscription: "both"})
+	}
+	return result
+}
+
+func testJids(contacts []*Contact) []string {
+	jids := make([]string, 0, len(contacts))
+	for _, contact := range contacts {
+		jids = append(jids, contact.Jid)
+	}
+	return jids
+}
+
+func TestGetRoster(t *testing.T) {
+	const a, b, c = "a@example.org", "b@example.org", "c@example.org"
+	for _, test := range []struct {
+		name     string
+		replies  func(id string) []interface{}
+		contacts []string
+		version  string
+		events   []string
+	}{
+		{"up to date", func(id string) []interface{} {
+			return []interface{}{testRosterResult(id, "")}
+		}, []string{a, b}, "v1", nil},
+		{"full result", func(id string) []interface{} {
+			return []interface{}{testRosterResult(id, "v2", a, c)}
+		}, []string{a, c}, "v2", nil},
+		{"pushes first", func(id string) []interface{} {
+			return []interface{}{testRosterPush("push1", "v2", c), testRosterResult(id, "")}
+		}, []string{a, b, c}, "v2", []string{c}},
+		{"pushes before full result", func(id string) []interface{} {
+			return []interface{}{testRosterPush("push1", "v3", c), testRosterResult(id, "v2", a)}
+		}, []string{a, c}, "v3", []string{c}},
+		{"push after result", func(id string) []interface{} {
+			return []interface{}{testRosterResult(id, "v2", a), testRosterPush("push1", "v3", c)}
+		}, []string{a, c}, "v3", []string{c}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryRosterStore()
+			store.Save("v1", []*Contact{{Jid: a}, {Jid: b}})
+			xmpp := testRosterConnection(store, test.replies, nil)
+			defer close(xmpp.done)
+			events := xmpp.RosterEvents()
+
+			if err := xmpp.GetRoster(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			testEventually(t, func() bool {
+				return len(xmpp.State.Roster.List()) == len(test.contacts)
+			})
+			if jids := testJids(xmpp.State.Roster.List()); !reflect.DeepEqual(jids, test.contacts) {
+				t.Errorf("roster = %v, want %v", jids, test.contacts)
+			}
+			testEventually(t, func() bool {
+				version, _, _ := store.Load()
+				return version == test.version
+			})
+			if _, stored, _ := store.Load(); !reflect.DeepEqual(testJids(stored), test.contacts) {
+				t.Errorf("stored roster = %v, want %v", testJids(stored), test.contacts)
+			}
+			for _, jid := range test.events {
+				select {
+				case event := <-events:
+					if event.Type != RosterAdd || event.Contact.Jid != jid {
+						t.Errorf("event = %s %s, want %s %s", event.Type, event.Contact.Jid, RosterAdd, jid)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("no event for %s", jid)
+				}
+			}
+		})
+	}
+}
+
+func TestRosterPushNotLoaded(t *testing.T) {
+	store := NewMemoryRosterStore()
+	xmpp := testRosterConnection(store, nil, nil)
+	defer close(xmpp.done)
+
+	xmpp.incoming <- incomingResult{Interface: testRosterPush("push1", "v2", "c@example.org")}
+	roster := xmpp.State.Roster
+	testEventually(t, func() bool {
+		roster.lock.RLock()
+		defer roster.lock.RUnlock()
+		return len(roster.queued) == 1
+	})
+	if contacts := roster.List(); len(contacts) != 0 {
+		t.Errorf("roster = %v, want it empty", testJids(contacts))
+	}
+	if version, contacts, _ := store.Load(); version != "" || len(contacts) != 0 {
+		t.Errorf("stored %q %v, want nothing", version, testJids(contacts))
+	}
+}
+
+func TestRosterPush(t *testing.T) {
+	const a, c = "a@example.org", "c@example.org"
+	for _, test := range []struct {
+		name     string
+		from     string
+		items    []*Item
+		ack      string // Type of the answer, then the error condition
+		event    string
+		contacts []string
+	}{
+		{"add", "", []*Item{{Jid: c, Subscription: "none"}}, "result", RosterAdd, []string{a, c}},
+		{"update", "user@example.org", []*Item{{Jid: a, Name: "A"}}, "result", RosterUpdate, []string{a}},
+		{"remove", "", []*Item{{Jid: a, Subscription: "remove"}}, "result", RosterRemove, []string{}},
+		{"third party", "mallory@example.net", []*Item{{Jid: c}}, "error service-unavailable", "", []string{a}},
+		{"other resource", "user@example.org/other", []*Item{{Jid: c}}, "error service-unavailable", "", []string{a}},
+		{"two items", "", []*Item{{Jid: c}, {Jid: "d@example.org"}}, "error bad-request", "", []string{a}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sent := make(chan *IQ, 1)
+			xmpp := testRosterConnection(NewMemoryRosterStore(), nil, sent)
+			defer close(xmpp.done)
+			roster := xmpp.State.Roster
+			roster.contacts = []*Contact{{Jid: a, Subscription: "both"}}
+			roster.loaded = true
+			events := xmpp.RosterEvents()
+
+			xmpp.incoming <- incomingResult{Interface: &IQ{Type: "set", ID: "push1", From: test.from, Query: &query{
+				XMLName: xml.Name{Space: nsRoster, Local: "query"},
+				Items:   test.items,
+			}}}
+
+			var ack *IQ
+			select {
+			case ack = <-sent:
+			case <-time.After(5 * time.Second):
+				t.Fatal("push not answered")
+			}
+			answer := ack.Type
+			if ack.Error != nil {
+				answer += " " + ack.Error.Condition
+			}
+			if ack.ID != "push1" || answer != test.ack {
+				t.Errorf("answer %s %q, want %q", ack.ID, answer, test.ack)
+			}
+
+			if test.event != "" {
+				select {
+				case event := <-events:
+					if event.Type != test.event || event.Contact.Jid != test.items[0].Jid {
+						t.Errorf("event = %s %s, want %s %s", event.Type, event.Contact.Jid, test.event, test.items[0].Jid)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("no event")
+				}
+			}
+			testEventually(t, func() bool {
+				return reflect.DeepEqual(testJids(roster.List()), test.contacts)
+			})
+			select {
+			case event := <-events:
+				t.Errorf("unexpected event %s %s", event.Type, event.Contact.Jid)
+			default:
+			}
+		})
+	}
+}
+
+func TestItemGroups(t *testing.T) {
+	item := &Item{Jid: "juliet@example.com", Name: "Juliet", Groups: []string{"Friends", "Lovers & Co"}}
+	data, err := xml.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 6121 # 2.1.2.4 — one <group/> element per group
+	want := `<item jid="juliet@example.com" name="Juliet"><group>Friends</group><group>Lovers &amp; Co</group></item>`
+	if string(data) != want {
+		t.Errorf("item = %s, want %s", data, want)
+	}
+	var parsed Item
+	if err := xml.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.Groups, item.Groups) {
+		t.Errorf("groups = %v, want %v", parsed.Groups, item.Groups)
+	}
+}
+
+func TestSetContact(t *testing.T) {
+	sent := make(chan *IQ, 1)
+	xmpp := testConnection(func(data string) interface{} {
+		var iq IQ
+		xml.Unmarshal([]byte(data), &iq)
+		sent <- &iq
+		return &IQ{ID: iq.ID, Type: "result"}
+	})
+	defer close(xmpp.done)
+	xmpp.mux = NewMux()
+	go xmpp.Process()
+
+	contact := Contact{Jid: "juliet@example.com/balcony", Name: "Juliet", Groups: []string{"Friends", "Lovers"}}
+	for name, set := range map[string]func(context.Context, Contact) error{
+		"add":    xmpp.AddContact,
+		"update": xmpp.UpdateContact,
+	} {
+		if err := set(context.Background(), contact); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		iq := <-sent
+		if iq.Type != "set" || iq.Query == nil || len(iq.Query.Items) != 1 {
+			t.Fatalf("%s sent %+v", name, iq)
+		}
+		item := iq.Query.Items[0]
+		if item.Jid != "juliet@example.com" || item.Name != "Juliet" || !reflect.DeepEqual(item.Groups, contact.Groups) {
+			t.Errorf("%s sent %+v", name, item)
+		}
+	}
+}
+
+func TestTrackPresence(t *testing.T) {
+	const bare, r1, r2 = "juliet@example.com", "juliet@example.com/balcony", "juliet@example.com/chamber"
+	for _, test := range []struct {
+		name      string
+		presences []*Presence
+		// Available resources, each with its show
+		available map[string]string
+	}{
+		{"two resources", []*Presence{{From: r1}, {From: r2, Show: "away"}}, map[string]string{r1: "", r2: "away"}},
+		{"updated", []*Presence{{From: r1, Show: "away"}, {From: r1, Show: "chat"}}, map[string]string{r1: "chat"}},
+		{"one unavailable", []*Presence{{From: r1}, {From: r2}, {From: r1, Type: "unavailable"}}, map[string]string{r2: ""}},
+		{"all unavailable", []*Presence{{From: r1}, {From: r1, Type: "unavailable"}}, map[string]string{}},
+		{"error", []*Presence{{From: r1}, {From: r2}, {From: bare, Type: "error"}}, map[string]string{}},
+		{"subscription request", []*Presence{{From: r1}, {From: bare, Type: "subscribe"}}, map[string]string{r1: ""}},
+		{"unavailable first", []*Presence{{From: r1, Type: "unavailable"}}, map[string]string{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			roster := &RosterConfig{}
+			for _, presence := range test.presences {
+				roster.trackPresence(presence)
+			}
+
+			for _, jid := range []string{bare, r1} {
+				available := make(map[string]string)
+				for _, presence := range roster.Presences(jid) {
+					available[presence.From] = presence.Show
+				}
+				if !reflect.DeepEqual(available, test.available) {
+					t.Errorf("Presences(%s) = %v, want %v", jid, available, test.available)
+				}
+			}
+			if available := roster.Available(bare); available != (len(test.available) > 0) {
+				t.Errorf("Available(%s) = %v", bare, available)
+			}
+			for _, jid := range []string{r1, r2} {
+				_, want := test.available[jid]
+				if available := roster.Available(jid); available != want {
+					t.Errorf("Available(%s) = %v, want %v", jid, available, want)
+				}
+			}
+			if roster.Available("romeo@example.net") {
+				t.Error("unknown contact available")
+			}
+		})
+	}
+}
+
+// Connection processing stanzas, the presences sent go to the channel
+func testPresenceConnection() (*XMPPConnection, <-chan *Presence) {
+	sent := make(chan *Presence, 4)
+	xmpp := testConnection(func(data string) interface{} {
+		var presence Presence
+		if xml.Unmarshal([]byte(data), &presence) == nil {
+			sent <- &presence
+		}
+		return nil
+	})
+	xmpp.mux = NewMux()
+	xmpp.subscriptions = make(chan *Presence, 4)
+	xmpp.State.Jid = "juliet@example.com/balcony"
+	xmpp.State.Roster = &RosterConfig{contacts: []*Contact{{Jid: "romeo@example.net", Subscription: "to"}}, loaded: true}
+	return xmpp, sent
+}
+
+func TestSubscriptionPolicy(t *testing.T) {
+	approve := func(*XMPPConnection, *Presence) SubscriptionDecision { return SubscriptionApprove }
+	deny := func(*XMPPConnection, *Presence) SubscriptionDecision { return SubscriptionDeny }
+	for _, test := range []struct {
+		name   string
+		policy SubscriptionPolicy
+		from   string
+		// Type of the presence answered, empty when the request is asked
+		answer string
+	}{
+		{"no policy", nil, "romeo@example.net", ""},
+		{"approve", approve, "mercutio@example.org/street", "subscribed"},
+		{"deny", deny, "tybalt@example.org", "unsubscribed"},
+		{"roster member", ApproveRosterMembers, "romeo@example.net/orchard", "subscribed"},
+		{"stranger", ApproveRosterMembers, "tybalt@example.org", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			xmpp, sent := testPresenceConnection()
+			defer close(xmpp.done)
+			xmpp.config.SubscriptionPolicy = test.policy
+			requests := xmpp.SubscriptionRequests()
+			go xmpp.Process()
+
+			xmpp.incoming <- incomingResult{Interface: &Presence{From: test.from, Type: "subscribe"}}
+
+			if test.answer == "" {
+				select {
+				case request := <-requests:
+					if request.From != test.from {
+						t.Errorf("request from %s, want %s", request.From, test.from)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("request not asked")
+				}
+				select {
+				case presence := <-sent:
+					t.Errorf("answered %s to %s", presence.Type, presence.To)
+				default:
+				}
+				return
+			}
+			select {
+			case presence := <-sent:
+				if presence.Type != test.answer || presence.To != bare_jid(test.from) {
+					t.Errorf("answered %s to %s, want %s to %s", presence.Type, presence.To, test.answer, bare_jid(test.from))
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("request not answered")
+			}
+			select {
+			case request := <-requests:
+				t.Errorf("request from %s asked", request.From)
+			default:
+			}
+		})
+	}
+}
+
+func TestPreApproveSubscription(t *testing.T) {
+	xmpp, sent := testPresenceConnection()
+	defer close(xmpp.done)
+
+	if err := xmpp.PreApproveSubscription(context.Background(), "romeo@example.net"); err != ErrPreApprovalUnsupported {
+		t.Fatalf("err = %v, want %v", err, ErrPreApprovalUnsupported)
+	}
+	select {
+	case presence := <-sent:
+		t.Fatalf("sent %s without the feature", presence.Type)
+	default:
+	}
+
+	xmpp.State.Roster.pre_approval_supported = true
+	if err := xmpp.PreApproveSubscription(context.Background(), "romeo@example.net/orchard"); err != nil {
+		t.Fatal(err)
+	}
+	if presence := <-sent; presence.Type != "subscribed" || presence.To != "romeo@example.net" {
+		t.Errorf("sent %s to %s", presence.Type, presence.To)
+	}
+}
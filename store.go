@@ -0,0 +1,198 @@
+package xmpp
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RosterStore persists the roster and its version between sessions
+// (RFC 6121 # 2.6 — Roster Versioning)
+type RosterStore interface {
+	// Load returns the stored version, empty when nothing is stored
+	Load() (version string, contacts []*Contact, err error)
+	Save(version string, contacts []*Contact) error
+}
+
+// MemoryRosterStore keeps the roster for the lifetime of the process
+type MemoryRosterStore struct {
+	lock     sync.Mutex
+	version  string
+	contacts []*Contact
+}
+
+func NewMemoryRosterStore() *MemoryRosterStore {
+	return &MemoryRosterStore{}
+}
+
+func (store *MemoryRosterStore) Load() (string, []*Contact, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	contacts := make([]*Contact, len(store.contacts))
+	copy(contacts, store.contacts)
+	return store.version, contacts, nil
+}
+
+func (store *MemoryRosterStore) Save(version string, contacts []*Contact) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.version = version
+	store.contacts = make([]*Contact, len(contacts))
+	copy(store.contacts, contacts)
+	return nil
+}
+
+// FileRosterStore keeps the roster in a JSON file
+type FileRosterStore struct {
+	Path string
+	lock sync.Mutex
+}
+
+type rosterFile struct {
+	Version  string     `json:"version"`
+	Contacts []*Contact `json:"contacts"`
+}
+
+func NewFileRosterStore(path string) *FileRosterStore {
+	return &FileRosterStore{Path: path}
+}
+
+func (store *FileRosterStore) Load() (string, []*Contact, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	data, err := os.ReadFile(store.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	var roster rosterFile
+	if err := json.Unmarshal(data, &roster); err != nil {
+		return "", nil, err
+	}
+	return roster.Version, roster.Contacts, nil
+}
+
+func (store *FileRosterStore) Save(version string, contacts []*Contact) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	data, err := json.MarshalIndent(rosterFile{version, contacts}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return write_file(store.Path, data)
+}
+
+// Write then rename, a crash never leaves a truncated file behind
+func write_file(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// TokenStore persists the FAST token between sessions (XEP 0484)
+type TokenStore interface {
+	// Load returns nil when nothing is stored
+	Load() (*FastToken, error)
+	// Save replaces the stored token, nil deletes it
+	Save(token *FastToken) error
+}
+
+// MemoryTokenStore keeps the token for the lifetime of the process
+type MemoryTokenStore struct {
+	lock  sync.Mutex
+	token *FastToken
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{}
+}
+
+func (store *MemoryTokenStore) Load() (*FastToken, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.token == nil {
+		return nil, nil
+	}
+	token := *store.token
+	return &token, nil
+}
+
+func (store *MemoryTokenStore) Save(token *FastToken) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if token == nil {
+		store.token = nil
+		return nil
+	}
+	saved := *token
+	store.token = &saved
+	return nil
+}
+
+// FileTokenStore keeps the token in a JSON file, readable by its owner only
+type FileTokenStore struct {
+	Path string
+	lock sync.Mutex
+}
+
+func NewFileTokenStore(path string) *FileTokenStore {
+	return &FileTokenStore{Path: path}
+}
+
+func (store *FileTokenStore) Load() (*FastToken, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	data, err := os.ReadFile(store.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var token FastToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (store *FileTokenStore) Save(token *FastToken) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if token == nil {
+		err := os.Remove(store.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+	return write_file(store.Path, data)
+}
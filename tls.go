@@ -2,42 +2,119 @@ package xmpp
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/xml"
-	"github.com/sirupsen/logrus"
+	"errors"
 	"net"
-	"os"
 )
 
-func (xmpp *XMPPConnection) EncryptConnection(domain string, conn net.Conn) {
-	starttls := &tlsStartTLS{}
-	output, _ := xml.Marshal(starttls)
-	xmpp.outgoing <- string(output)
+// TLSPolicy decides whether the stream must be encrypted with STARTTLS
+type TLSPolicy int
+
+const (
+	// Abort unless STARTTLS succeeds, a stripped feature list never leads
+	// to a plaintext login
+	TLSRequired TLSPolicy = iota
+	// Use STARTTLS when offered, continue in plaintext otherwise
+	TLSOpportunistic
+	// Never use STARTTLS
+	TLSDisabled
+)
 
-	f, err := os.Create("/home/sacha/lol.txt")
-	defer f.Close()
+// RFC 6120 # 5 — STARTTLS Negotiation, following the TLS policy. The
+// exchange is abandoned once the context is done.
+func (xmpp *XMPPConnection) EncryptConnection(ctx context.Context, domain string, conn net.Conn) error {
+	policy := xmpp.config.TLSPolicy
+	if policy == TLSDisabled {
+		xmpp.log.Warn("TLS disabled, the stream is in plaintext")
+		return nil
+	}
+	if xmpp.features == nil || xmpp.features.StartTLS == nil {
+		if policy == TLSRequired {
+			return &TLSError{Err: ErrStartTLSMissing}
+		}
+		xmpp.log.Warn("STARTTLS not offered, the stream is in plaintext")
+		return nil
+	}
 
-	w := bufio.NewWriter(f)
+	starttls := &tlsStartTLS{}
+	output, _ := xml.Marshal(starttls)
+	if err := xmpp.send(ctx, string(output)); err != nil {
+		return &TLSError{Err: err}
+	}
 
 	// <proceed>
-	xmpp.NextElement()
+	proceed := xmpp.nextElement(ctx)
+	if proceed.Error != nil {
+		return &TLSError{Err: proceed.Error}
+	}
+	switch proceed.Interface.(type) {
+	case *tlsProceed:
+	case *tlsFailure:
+		// RFC 6120 # 5.4.2.2 — the server closes the stream
+		return &TLSError{Err: ErrStartTLSFailed}
+	default:
+		return &TLSError{Err: errors.New("unexpected STARTTLS answer")}
+	}
 
-	conf := &tls.Config{
-		ServerName:         domain,
-		KeyLogWriter:       w,
-		InsecureSkipVerify: true,
+	if err := xmpp.handshake(ctx, domain, conn, false); err != nil {
+		return err
+	}
+	if err := xmpp.StartStream(ctx, domain); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Run the TLS handshake and switch the stream over it. Direct TLS (XEP 0368)
+// announces the xmpp-client ALPN protocol.
+func (xmpp *XMPPConnection) handshake(ctx context.Context, domain string, conn net.Conn, direct_tls bool) error {
+	conf := xmpp.config.tlsConfig(domain)
+	if direct_tls && len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{"xmpp-client"}
+	}
+	if conf.InsecureSkipVerify {
+		xmpp.log.WithField("domain", domain).Warn("TLS certificate verification DISABLED, the connection is open to interception")
+	}
+	if conf.KeyLogWriter != nil {
+		xmpp.log.Warn("TLS key log enabled, session secrets are written out")
 	}
 
 	// TLS Handshake
-	logrus.Info("TLS Handshake")
+	xmpp.log.Info("TLS Handshake")
 	t := tls.Client(conn, conf)
-	err = t.Handshake()
-	LogError(err, "TLS Handshake")
-
-	xmpp.reader = xml.NewDecoder(teeIn{t})
-	xmpp.writer = bufio.NewWriter(teeOut{t})
+	if err := t.HandshakeContext(ctx); err != nil {
+		return &TLSError{Err: err}
+	}
 
-	xmpp.StartStream(domain)
+	xmpp.tls = t
+	xmpp.reader = xml.NewDecoder(teeIn{t, xmpp.log})
+	xmpp.writer = bufio.NewWriter(teeOut{t, xmpp.log})
+	return nil
+}
 
-	w.Flush()
+// Match the SHA-256 of the SubjectPublicKeyInfo against the pins. Only the
+// verified chains count: the server may send any extra certificate. Without
+// verification, only the key the server proved to hold counts.
+func verify_pins(state tls.ConnectionState, pins [][]byte) error {
+	var certs []*x509.Certificate
+	for _, chain := range state.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(state.VerifiedChains) == 0 && len(state.PeerCertificates) > 0 {
+		certs = state.PeerCertificates[:1]
+	}
+	for _, cert := range certs {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(hash[:], pin) == 1 {
+				return nil
+			}
+		}
+	}
+	return ErrCertificatePin
 }
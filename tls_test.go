@@ -0,0 +1,143 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// SHA-256 of the SubjectPublicKeyInfo of the leaf certificate
+func testPin(t *testing.T, cert tls.Certificate) []byte {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+// Dial a stand-in server presenting the certificate chain
+func testDialChain(t *testing.T, chain tls.Certificate, config ClientConfig) error {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serveTestClient(listener, &tls.Config{Certificates: []tls.Certificate{chain}}, `<mechanism>PLAIN</mechanism>`, false)
+
+	config.Account = "user@example.org"
+	config.Password = "secret"
+	config.Resource = "res"
+	config.Address = listener.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	xmpp, err := Dial(ctx, config)
+	if err == nil {
+		xmpp.Close()
+	}
+	return err
+}
+
+func TestPinnedKeys(t *testing.T) {
+	ca := newTestAuthority(t)
+	server := ca.issue(t, "example.org", false)
+	// Mis-issued by a trusted CA, the real certificate appended to the chain
+	mitm := ca.issue(t, "example.org", false)
+	mitm.Certificate = append(mitm.Certificate, server.Certificate[0])
+	ca_pin := sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)
+
+	for _, test := range []struct {
+		name     string
+		chain    tls.Certificate
+		pins     [][]byte
+		insecure bool
+		err      error
+	}{
+		{"server key", server, [][]byte{testPin(t, server)}, false, nil},
+		{"CA key", server, [][]byte{ca_pin[:]}, false, nil},
+		{"mismatch", server, [][]byte{make([]byte, 32)}, false, ErrCertificatePin},
+		{"pinned certificate appended", mitm, [][]byte{testPin(t, server)}, false, ErrCertificatePin},
+		{"insecure server key", server, [][]byte{testPin(t, server)}, true, nil},
+		{"insecure pinned certificate appended", mitm, [][]byte{testPin(t, server)}, true, ErrCertificatePin},
+		{"insecure CA key", server, [][]byte{ca_pin[:]}, true, ErrCertificatePin},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := ClientConfig{PinnedKeys: test.pins, InsecureSkipVerify: test.insecure}
+			if !test.insecure {
+				config.RootCAs = ca.pool
+			}
+			err := testDialChain(t, test.chain, config)
+			if test.err == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var tls_error *TLSError
+			if !errors.Is(err, test.err) || !errors.As(err, &tls_error) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if Retryable(err) {
+				t.Error("pin failure is retryable")
+			}
+		})
+	}
+}
+
+func TestStartTLSPolicy(t *testing.T) {
+	ca := newTestAuthority(t)
+	server_conf := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.org", false)}}
+
+	for _, test := range []struct {
+		name     string
+		policy   TLSPolicy
+		starttls string
+		answer   string
+		err      error
+	}{
+		{"stripped", TLSRequired, "", "", ErrStartTLSMissing},
+		{"failure", TLSRequired, `<starttls xmlns='` + nsStartTLS + `'/>`, `<failure xmlns='` + nsStartTLS + `'/>`, ErrStartTLSFailed},
+		// Nothing but PLAIN left in clear
+		{"opportunistic stripped", TLSOpportunistic, "", "", ErrNoMechanism},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			server := &testServer{
+				mechanisms: `<mechanism>PLAIN</mechanism>`,
+				starttls:   test.starttls,
+				answer:     test.answer,
+			}
+			auth := server.serve(listener, server_conf)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			xmpp, err := Dial(ctx, ClientConfig{
+				Account:   "user@example.org",
+				Password:  "secret",
+				Address:   listener.Addr().String(),
+				RootCAs:   ca.pool,
+				TLSPolicy: test.policy,
+			})
+			if err == nil {
+				xmpp.Close()
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if payload, ok := <-auth; ok {
+				t.Errorf("auth %q sent in clear", payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// XEP 0004 — Data Forms
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+type DataForm struct {
+	XMLName      xml.Name     `xml:"jabber:x:data x"`
+	Type         string       `xml:"type,attr"`
+	Title        string       `xml:"title,omitempty"`
+	Instructions []string     `xml:"instructions,omitempty"`
+	Fields       []*FormField `xml:"field"`
+}
+
+// XEP 0004 # 3.2 — Field Element
+type FormField struct {
+	Var         string       `xml:"var,attr,omitempty"`
+	Type        string       `xml:"type,attr,omitempty"`
+	Label       string       `xml:"label,attr,omitempty"`
+	Description string       `xml:"desc,omitempty"`
+	Required    *struct{}    `xml:"required"` // Set when the field must be filled
+	Values      []string     `xml:"value"`
+	Options     []FormOption `xml:"option"`
+}
+
+type FormOption struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// Field returns the field named var, nil when absent
+func (form *DataForm) Field(name string) *FormField {
+	for _, field := range form.Fields {
+		if field.Var == name {
+			return field
+		}
+	}
+	return nil
+}
+
+// Set replaces the values of a field, adding it when absent
+func (form *DataForm) Set(name string, values ...string) {
+	if field := form.Field(name); field != nil {
+		field.Values = values
+		return
+	}
+	form.Fields = append(form.Fields, &FormField{Var: name, Values: values})
+}
+
+// Whether the field carries a value
+func (field *FormField) filled() bool {
+	for _, value := range field.Values {
+		if value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// XEP 0004 # 3.3 — the submitted form only carries the values, fields left
+// empty are omitted
+func (form *DataForm) submit() *DataForm {
+	submit := &DataForm{Type: "submit"}
+	for _, field := range form.Fields {
+		if field.Var == "" || field.Type == "fixed" || !field.filled() {
+			continue
+		}
+		submit.Fields = append(submit.Fields, &FormField{
+			Var:    field.Var,
+			Type:   field.Type,
+			Values: field.Values,
+		})
+	}
+	return submit
+}
@@ -2,20 +2,24 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"github.com/sirupsen/logrus"
-	"strconv"
 )
 
+// Results of the last discovery
 type DiscoveryConfig struct {
-	incoming chan *clientIQ
+	Jid        string
+	Identities []*Identity
+	Features   []*Feature
 }
 
 // XEP 0030 # 3.1 — Basic Protocol
 type Identity struct {
 	XMLName  xml.Name `xml:"identity"`
 	Type     string   `xml:"type,attr"`
-	Name     string   `xml:"name,attr"`
+	Name     string   `xml:"name,attr,omitempty"`
 	Category string   `xml:"category,attr"`
 }
 
@@ -24,79 +28,98 @@ type Feature struct {
 	Var     string   `xml:"var,attr"`
 }
 
-func (xmppconn *XMPPConnection) Disco(to string) {
-	xmppconn.State.Discovery = &DiscoveryConfig{
-		incoming: make(chan *clientIQ),
+// XEP 0030 # 3.1 — Answer disco#info with the features added to the Mux
+func handleDiscoInfo(xmppconn *XMPPConnection, iq *IQ) {
+	result := iq.Result()
+	result.Query = &query{
+		XMLName:    xml.Name{Local: "query", Space: nsDiscoInfo},
+		Identities: []*Identity{{Category: "client", Type: "pc"}},
+	}
+	// XEP 0115 # 6.2 — the node (node#ver for caps) is echoed back
+	if iq.Query != nil {
+		result.Query.Node = iq.Query.Node
+	}
+	for _, feature := range xmppconn.mux.Features() {
+		result.Query.Features = append(result.Query.Features, &Feature{Var: feature})
 	}
+	xmppconn.Send(context.Background(), result)
+}
 
+func (xmppconn *XMPPConnection) Disco(ctx context.Context, to string) error {
 	query := &query{XMLName: xml.Name{Local: "query", Space: nsDiscoInfo}}
-	query_disco_id := strconv.FormatUint(uint64(get_cookie()), 10)
-	query_disco := &clientIQ{
+	query_disco := &IQ{
 		Type:  "get",
-		ID:    query_disco_id,
 		From:  xmppconn.State.Jid,
 		To:    to,
 		Query: query,
 	}
-	output, _ := xml.Marshal(query_disco)
 
-	logrus.Info("[XEP 0030] Starting discovery on " + to + "…")
-	xmppconn.outgoing <- string(output)
+	xmppconn.log.Info("[XEP 0030] Starting discovery on " + to + "…")
+	response, err := xmppconn.SendIQ(ctx, query_disco)
+	if err != nil {
+		return err
+	}
+	if response.Query == nil {
+		return errors.New("empty discovery result")
+	}
 
-	for {
-		response := <-xmppconn.State.Discovery.incoming
-		logrus.Info("[XEP 0030] Received discovery response for " + to)
+	xmppconn.log.Info("[XEP 0030] Received discovery response for " + to)
 
-		for _, attr := range response.Query.Features {
-			switch attr.Var {
-			case nsPing:
-				logrus.Info("[XEP 0030] ✔ XMPP Ping (XEP-0199)")
-			case nsLastActivity:
-				logrus.Info("[XEP 0030] ✔ Last Activity (XEP-0012)")
-			case nsCommands:
-				logrus.Info("[XEP 0030] ✔ Ad-Hoc Commands (XEP-0050)")
-			case nsBlocking:
-				logrus.Info("[XEP 0030] ✔ Blocking Command (XEP-0191)")
-			case nsMam:
-				logrus.Info("[XEP 0030] ✔ Message Archive Management (XEP-0313)")
-			case nsPush:
-				logrus.Info("[XEP 0030] ✔ Push Notifications (XEP-0357)")
-			case nsUniqueStanza:
-				logrus.Info("[XEP 0030] ✔ Unique and Stable Stanza IDs (XEP-0359)")
-			case nsPubSubPublish:
-				logrus.Info("[XEP 0030] ✔ Publish-Subscribe (Publishing items) (XEP-0060)")
-			case nsOffline:
-				logrus.Info("[XEP 0030] ✔ Handling Offline Messages (XEP-0160)")
-			case nsVcard:
-				logrus.Info("[XEP 0030] ✔ vCard XML (XEP-0054)")
-			case nsRoster:
-				logrus.Info("[XEP 0030] ✔ Roster (RFC 3921)")
-			case nsVersion:
-				logrus.Info("[XEP 0030] ✔ Sofware Version (XEP-0092)")
-			case nsTime:
-				logrus.Info("[XEP 0030] ✔ Entity Time (XEP-0202)")
-			case nsPrivate:
-				logrus.Info("[XEP 0030] ✔ Private XML Storage (XEP-0049)")
-			case nsRegister:
-				logrus.Info("[XEP 0030] ✔ In-Band Registration (XEP-0077)")
-			case nsDiscoInfo:
-				logrus.Info("[XEP 0030] ✔ Service Discovery — Info (XEP-0030)")
-			case nsDiscoItems:
-				logrus.Info("[XEP 0030] ✔ Service Discovery — Items (XEP-0030)")
-			case nsCarbons:
-				logrus.Info("[XEP 0030] ✔ Message Carbons (XEP-0280)")
-			default:
-				logrus.Info("[XEP 0030] ✘ Unknown feature (" + attr.Var + ")")
-			}
+	for _, attr := range response.Query.Features {
+		switch attr.Var {
+		case nsPing:
+			xmppconn.log.Info("[XEP 0030] ✔ XMPP Ping (XEP-0199)")
+		case nsLastActivity:
+			xmppconn.log.Info("[XEP 0030] ✔ Last Activity (XEP-0012)")
+		case nsCommands:
+			xmppconn.log.Info("[XEP 0030] ✔ Ad-Hoc Commands (XEP-0050)")
+		case nsBlocking:
+			xmppconn.log.Info("[XEP 0030] ✔ Blocking Command (XEP-0191)")
+		case nsMam:
+			xmppconn.log.Info("[XEP 0030] ✔ Message Archive Management (XEP-0313)")
+		case nsPush:
+			xmppconn.log.Info("[XEP 0030] ✔ Push Notifications (XEP-0357)")
+		case nsUniqueStanza:
+			xmppconn.log.Info("[XEP 0030] ✔ Unique and Stable Stanza IDs (XEP-0359)")
+		case nsPubSubPublish:
+			xmppconn.log.Info("[XEP 0030] ✔ Publish-Subscribe (Publishing items) (XEP-0060)")
+		case nsOffline:
+			xmppconn.log.Info("[XEP 0030] ✔ Handling Offline Messages (XEP-0160)")
+		case nsVcard:
+			xmppconn.log.Info("[XEP 0030] ✔ vCard XML (XEP-0054)")
+		case nsRoster:
+			xmppconn.log.Info("[XEP 0030] ✔ Roster (RFC 3921)")
+		case nsVersion:
+			xmppconn.log.Info("[XEP 0030] ✔ Sofware Version (XEP-0092)")
+		case nsTime:
+			xmppconn.log.Info("[XEP 0030] ✔ Entity Time (XEP-0202)")
+		case nsPrivate:
+			xmppconn.log.Info("[XEP 0030] ✔ Private XML Storage (XEP-0049)")
+		case nsRegister:
+			xmppconn.log.Info("[XEP 0030] ✔ In-Band Registration (XEP-0077)")
+		case nsDiscoInfo:
+			xmppconn.log.Info("[XEP 0030] ✔ Service Discovery — Info (XEP-0030)")
+		case nsDiscoItems:
+			xmppconn.log.Info("[XEP 0030] ✔ Service Discovery — Items (XEP-0030)")
+		case nsCarbons:
+			xmppconn.log.Info("[XEP 0030] ✔ Message Carbons (XEP-0280)")
+		default:
+			xmppconn.log.Info("[XEP 0030] ✘ Unknown feature (" + attr.Var + ")")
 		}
+	}
 
-		for _, attr := range response.Query.Identities {
-			logrus.WithFields(logrus.Fields{
-				"type":     attr.Type,
-				"name":     attr.Name,
-				"category": attr.Category,
-			}).Info("[XEP 0030] Found identity")
-		}
-		return
+	for _, attr := range response.Query.Identities {
+		xmppconn.log.WithFields(logrus.Fields{
+			"type":     attr.Type,
+			"name":     attr.Name,
+			"category": attr.Category,
+		}).Info("[XEP 0030] Found identity")
+	}
+
+	xmppconn.State.Discovery = &DiscoveryConfig{
+		Jid:        to,
+		Identities: response.Query.Identities,
+		Features:   response.Query.Features,
 	}
+	return nil
 }
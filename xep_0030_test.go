@@ -0,0 +1,65 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiscoInfo(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		node     string
+		add      []string
+		features []string
+	}{
+		{"no node", "", nil, []string{nsDiscoInfo, nsPing}},
+		{"caps node", "https://example.org/client#QgayPKawpkPSDYmwT/WM94uAlu0=", nil, []string{nsDiscoInfo, nsPing}},
+		{"added feature", "", []string{nsCarbons}, []string{nsDiscoInfo, nsCarbons, nsPing}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sent := make(chan string, 1)
+			xmpp := testConnection(func(data string) interface{} {
+				sent <- data
+				return nil
+			})
+			defer close(xmpp.done)
+			xmpp.mux = NewMux()
+			// Handlers are not advertised
+			xmpp.mux.handleIQDefault("set", xml.Name{Space: nsRoster, Local: "query"}, handleRosterPush)
+			xmpp.mux.AddFeature(nsDiscoInfo, nsPing)
+			xmpp.mux.AddFeature(test.add...)
+
+			handleDiscoInfo(xmpp, &IQ{
+				ID:    "disco1",
+				From:  "peer@example.org/res",
+				Type:  "get",
+				Query: &query{XMLName: xml.Name{Space: nsDiscoInfo, Local: "query"}, Node: test.node},
+			})
+
+			var result IQ
+			select {
+			case data := <-sent:
+				if err := xml.Unmarshal([]byte(data), &result); err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no answer")
+			}
+			if result.Type != "result" || result.ID != "disco1" || result.Query == nil {
+				t.Fatalf("answer %+v", result)
+			}
+			if result.Query.Node != test.node {
+				t.Errorf("node = %q, want %q", result.Query.Node, test.node)
+			}
+			var features []string
+			for _, feature := range result.Query.Features {
+				features = append(features, feature.Var)
+			}
+			if !reflect.DeepEqual(features, test.features) {
+				t.Errorf("features = %v, want %v", features, test.features)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+// XEP 0077 — In-Band Registration
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// XEP 0077 # 4 — Stream Feature
+type registerFeature struct {
+	XMLName xml.Name `xml:"http://jabber.org/features/iq-register register"`
+}
+
+// Registration is what the server asks to register an account
+type Registration struct {
+	Instructions string
+	// Registered is set when the account already exists
+	Registered bool
+	// Fields to submit by name, such as "username", "password" or "email".
+	// The username and password are filled from the config, the server
+	// expects every other one filled too.
+	Fields map[string]string
+	// Form replaces Fields when the server uses a data form
+	Form *DataForm
+}
+
+// Read the value of a registration field
+func register_field_value(field Extension) string {
+	var value struct {
+		Data string `xml:",chardata"`
+	}
+	xml.Unmarshal(append(append([]byte("<v>"), field.Inner...), "</v>"...), &value)
+	return value.Data
+}
+
+func register_field(name string, value string) Extension {
+	var inner bytes.Buffer
+	xml.EscapeText(&inner, []byte(value))
+	return Extension{
+		XMLName: xml.Name{Space: nsRegister, Local: name},
+		Inner:   inner.Bytes(),
+	}
+}
+
+func newRegistration(query *query) *Registration {
+	registration := &Registration{
+		Instructions: query.Instructions,
+		Registered:   query.Registered != nil,
+		Fields:       make(map[string]string),
+		Form:         query.Form,
+	}
+	for _, field := range query.Fields {
+		if field.XMLName.Space == nsRegister {
+			registration.Fields[field.XMLName.Local] = register_field_value(field)
+		}
+	}
+	return registration
+}
+
+// Build the query submitting the registration. Every legacy field and the
+// required form fields must be filled, an empty value is never submitted.
+func (registration *Registration) query() (*query, error) {
+	query := &query{XMLName: xml.Name{Space: nsRegister, Local: "query"}}
+	var missing []string
+	if registration.Form != nil {
+		for _, field := range registration.Form.Fields {
+			if field.Required != nil && !field.filled() {
+				missing = append(missing, field.Var)
+			}
+		}
+		query.Form = registration.Form.submit()
+	} else {
+		for name, value := range registration.Fields {
+			if value == "" {
+				missing = append(missing, name)
+				continue
+			}
+			query.Fields = append(query.Fields, register_field(name, value))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%w: %s", ErrRegistrationIncomplete, strings.Join(missing, ", "))
+	}
+	return query, nil
+}
+
+// Turn an IQ error into a RegisterError
+func register_error(err error) error {
+	if err == nil {
+		return nil
+	}
+	var stanza_error *StanzaError
+	if errors.As(err, &stanza_error) {
+		register_error := &RegisterError{
+			Condition: stanza_error.Condition,
+			Text:      stanza_error.Text,
+			Err:       stanza_error,
+		}
+		if condition, ok := registerConditions[stanza_error.Condition]; ok {
+			register_error.Err = condition
+		}
+		return register_error
+	}
+	return &RegisterError{Err: err}
+}
+
+// Send an IQ before the session is established, Process is not running yet
+func (xmpp *XMPPConnection) negotiationIQ(ctx context.Context, iq *IQ) (*IQ, error) {
+	iq.ID = strconv.FormatUint(uint64(get_cookie()), 10)
+	output, err := xml.Marshal(iq)
+	if err != nil {
+		return nil, err
+	}
+	if err := xmpp.send(ctx, string(output)); err != nil {
+		return nil, err
+	}
+	for {
+		incoming, err := xmpp.receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, ok := incoming.Interface.(*IQ)
+		if !ok || response.ID != iq.ID {
+			continue
+		}
+		if response.Type == "error" {
+			if response.Error == nil {
+				response.Error = &StanzaError{Type: "cancel", Condition: "undefined-condition"}
+			}
+			return response, response.Error
+		}
+		return response, nil
+	}
+}
+
+// RegisterAccount creates the account of the config before logging in
+// (XEP 0077 # 3.1). The username and password come from the config, fill
+// completes the other fields or the data form asked by the server, it may be
+// nil.
+func RegisterAccount(ctx context.Context, config ClientConfig, fill func(registration *Registration) error) error {
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+
+	xmpp, stop, err := negotiate(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	defer xmpp.Close()
+	return xmpp.register(ctx, config, fill)
+}
+
+// Ask for the registration fields, fill them and submit them
+func (xmpp *XMPPConnection) register(ctx context.Context, config ClientConfig, fill func(registration *Registration) error) error {
+	fail := func(err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return register_error(err)
+	}
+
+	domain := config.domain()
+	if xmpp.features == nil || xmpp.features.Register == nil {
+		xmpp.log.Warn("[XEP 0077] Registration not advertised, trying anyway")
+	}
+
+	response, err := xmpp.negotiationIQ(ctx, &IQ{
+		Type:  "get",
+		To:    domain,
+		Query: &query{XMLName: xml.Name{Space: nsRegister, Local: "query"}},
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if response.Query == nil {
+		return fail(errors.New("empty registration form"))
+	}
+	registration := newRegistration(response.Query)
+
+	username := jid_localpart(config.Account)
+	if registration.Form != nil {
+		if registration.Form.Field("username") != nil {
+			registration.Form.Set("username", username)
+		}
+		if registration.Form.Field("password") != nil {
+			registration.Form.Set("password", config.Password)
+		}
+	} else {
+		registration.Fields["username"] = username
+		registration.Fields["password"] = config.Password
+	}
+	if fill != nil {
+		if err := fill(registration); err != nil {
+			return err
+		}
+	}
+
+	submit, err := registration.query()
+	if err != nil {
+		return fail(err)
+	}
+
+	xmpp.log.WithFields(logrus.Fields{
+		"username": username,
+		"domain":   domain,
+	}).Info("[XEP 0077] Registering account")
+	_, err = xmpp.negotiationIQ(ctx, &IQ{
+		Type:  "set",
+		To:    domain,
+		Query: submit,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	xmpp.log.Info("[XEP 0077] Account registered")
+	return nil
+}
+
+// XEP 0077 # 3.3 — Password Change
+func (xmpp *XMPPConnection) ChangePassword(ctx context.Context, password string) error {
+	username := jid_localpart(xmpp.State.Jid)
+	registration := &Registration{Fields: map[string]string{
+		"username": username,
+		"password": password,
+	}}
+
+	submit, err := registration.query()
+	if err != nil {
+		return register_error(err)
+	}
+
+	xmpp.log.Info("[XEP 0077] Changing password")
+	_, err = xmpp.SendIQ(ctx, &IQ{
+		Type:  "set",
+		To:    xmpp.config.domain(),
+		Query: submit,
+	})
+	return register_error(err)
+}
+
+// XEP 0077 # 3.2 — Account Cancellation, the server then closes the stream
+func (xmpp *XMPPConnection) CancelRegistration(ctx context.Context) error {
+	xmpp.log.Info("[XEP 0077] Cancelling registration")
+	_, err := xmpp.SendIQ(ctx, &IQ{
+		Type: "set",
+		To:   xmpp.config.domain(),
+		Query: &query{
+			XMLName: xml.Name{Space: nsRegister, Local: "query"},
+			Remove:  &struct{}{},
+		},
+	})
+	return register_error(err)
+}
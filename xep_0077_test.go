@@ -0,0 +1,217 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Registration query answered to the get, nil fields for a data form
+func testRegistrationForm(fields []string, form *DataForm) *query {
+	query := &query{XMLName: xml.Name{Space: nsRegister, Local: "query"}, Form: form}
+	for _, name := range fields {
+		query.Fields = append(query.Fields, register_field(name, ""))
+	}
+	return query
+}
+
+// Values submitted with the set, by field name
+func testSubmitted(query *query) map[string]string {
+	values := make(map[string]string)
+	if query.Form != nil {
+		for _, field := range query.Form.Fields {
+			values[field.Var] = field.Values[0]
+		}
+		return values
+	}
+	for _, field := range query.Fields {
+		values[field.XMLName.Local] = register_field_value(field)
+	}
+	return values
+}
+
+func TestRegisterAccount(t *testing.T) {
+	form := func() *DataForm {
+		return &DataForm{Type: "form", Fields: []*FormField{
+			{Var: "FORM_TYPE", Type: "hidden", Values: []string{nsRegister}},
+			{Type: "fixed", Values: []string{"Choose a username"}},
+			{Var: "username", Type: "text-single", Required: &struct{}{}},
+			{Var: "password", Type: "text-private", Required: &struct{}{}},
+			{Var: "email", Type: "text-single"},
+			{Var: "ocr", Type: "text-single", Required: &struct{}{}},
+		}}
+	}
+	for _, test := range []struct {
+		name   string
+		query  *query
+		fill   map[string]string
+		submit map[string]string
+		err    error
+	}{
+		{
+			name:   "legacy fields",
+			query:  testRegistrationForm([]string{"username", "password", "email"}, nil),
+			fill:   map[string]string{"email": "user@example.net"},
+			submit: map[string]string{"username": "user", "password": "secret", "email": "user@example.net"},
+		},
+		{
+			name:  "legacy field left empty",
+			query: testRegistrationForm([]string{"username", "password", "email"}, nil),
+			err:   ErrRegistrationIncomplete,
+		},
+		{
+			// The optional email is not submitted empty
+			name:   "data form",
+			query:  testRegistrationForm(nil, form()),
+			fill:   map[string]string{"ocr": "7nHL3"},
+			submit: map[string]string{"FORM_TYPE": nsRegister, "username": "user", "password": "secret", "ocr": "7nHL3"},
+		},
+		{
+			name:  "required form field left empty",
+			query: testRegistrationForm(nil, form()),
+			err:   ErrRegistrationIncomplete,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var submitted *query
+			xmpp := testConnection(func(data string) interface{} {
+				var iq IQ
+				xml.Unmarshal([]byte(data), &iq)
+				if iq.Type == "set" {
+					submitted = iq.Query
+					return &IQ{ID: iq.ID, Type: "result"}
+				}
+				return &IQ{ID: iq.ID, Type: "result", Query: test.query}
+			})
+			defer close(xmpp.done)
+
+			config := ClientConfig{Account: "user@example.org", Password: "secret"}
+			err := xmpp.register(context.Background(), config, func(registration *Registration) error {
+				for name, value := range test.fill {
+					if registration.Form != nil {
+						registration.Form.Set(name, value)
+					} else {
+						registration.Fields[name] = value
+					}
+				}
+				return nil
+			})
+			if test.err != nil {
+				var register_error *RegisterError
+				if !errors.Is(err, test.err) || !errors.As(err, &register_error) {
+					t.Fatalf("err = %v, want %v", err, test.err)
+				}
+				if submitted != nil {
+					t.Error("incomplete registration submitted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if submitted == nil {
+				t.Fatal("nothing submitted")
+			}
+			if test.query.Form != nil && (submitted.Form == nil || submitted.Form.Type != "submit") {
+				t.Errorf("form = %+v, want a submitted form", submitted.Form)
+			}
+			if values := testSubmitted(submitted); !reflect.DeepEqual(values, test.submit) {
+				t.Errorf("submitted %v, want %v", values, test.submit)
+			}
+		})
+	}
+}
+
+// Connection answering each IQ set with answer, the IQ sent is recorded
+func testRegisterConnection(answer func(data string) interface{}) (*XMPPConnection, <-chan *IQ) {
+	sent := make(chan *IQ, 1)
+	xmpp := testConnection(func(data string) interface{} {
+		var iq IQ
+		xml.Unmarshal([]byte(data), &iq)
+		sent <- &iq
+		return answer(data)
+	})
+	xmpp.mux = NewMux()
+	xmpp.State.Jid = "user@example.org/res"
+	xmpp.config.Account = "user@example.org"
+	go xmpp.Process()
+	return xmpp, sent
+}
+
+func testIQAck(data string) interface{} {
+	var iq IQ
+	xml.Unmarshal([]byte(data), &iq)
+	return &IQ{ID: iq.ID, Type: "result"}
+}
+
+func TestChangePassword(t *testing.T) {
+	xmpp, sent := testRegisterConnection(testIQAck)
+	defer close(xmpp.done)
+
+	if err := xmpp.ChangePassword(context.Background(), "n3w"); err != nil {
+		t.Fatal(err)
+	}
+	iq := <-sent
+	if iq.Type != "set" || iq.To != "example.org" || iq.Query == nil {
+		t.Fatalf("sent %+v", iq)
+	}
+	want := map[string]string{"username": "user", "password": "n3w"}
+	if values := testSubmitted(iq.Query); !reflect.DeepEqual(values, want) {
+		t.Errorf("submitted %v, want %v", values, want)
+	}
+
+	// Nothing is sent without a password
+	if err := xmpp.ChangePassword(context.Background(), ""); !errors.Is(err, ErrRegistrationIncomplete) {
+		t.Errorf("err = %v, want %v", err, ErrRegistrationIncomplete)
+	}
+}
+
+func TestCancelRegistration(t *testing.T) {
+	xmpp, sent := testRegisterConnection(testIQAck)
+	defer close(xmpp.done)
+
+	if err := xmpp.CancelRegistration(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	iq := <-sent
+	if iq.Type != "set" || iq.To != "example.org" || iq.Query == nil || iq.Query.Remove == nil {
+		t.Errorf("sent %+v, want a <remove/> query", iq)
+	}
+}
+
+func TestRegisterError(t *testing.T) {
+	for _, test := range []struct {
+		condition string
+		want      error
+	}{
+		{"conflict", ErrRegistrationConflict},
+		{"not-acceptable", ErrRegistrationNotAcceptable},
+		{"not-allowed", ErrRegistrationNotAllowed},
+		{"service-unavailable", nil},
+	} {
+		t.Run(test.condition, func(t *testing.T) {
+			xmpp, _ := testRegisterConnection(func(data string) interface{} {
+				return testIQError(data, &StanzaError{Type: "cancel", Condition: test.condition, Text: "sorry"})
+			})
+			defer close(xmpp.done)
+
+			err := xmpp.ChangePassword(context.Background(), "n3w")
+			var register_error *RegisterError
+			if !errors.As(err, &register_error) {
+				t.Fatalf("err = %v, want *RegisterError", err)
+			}
+			if register_error.Condition != test.condition || register_error.Text != "sorry" {
+				t.Errorf("err = %+v", register_error)
+			}
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("err = %v, want %v", err, test.want)
+			}
+			var stanza_error *StanzaError
+			if test.want == nil && !errors.As(err, &stanza_error) {
+				t.Errorf("err = %v, want the stanza error", err)
+			}
+		})
+	}
+}
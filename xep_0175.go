@@ -0,0 +1,26 @@
+// XEP 0175 — Best Practices for Use of SASL ANONYMOUS
+package xmpp
+
+// RFC 4505 — Anonymous SASL Mechanism, used when no account is configured.
+// The server assigns a temporary JID, known once the resource is bound.
+type anonymousMechanism struct{}
+
+func newAnonymous(credentials *Credentials) Mechanism {
+	if credentials.Account != "" || credentials.Password != "" {
+		return nil
+	}
+	return &anonymousMechanism{}
+}
+
+func (anonymous *anonymousMechanism) Name() string {
+	return "ANONYMOUS"
+}
+
+// RFC 4505 # 2 — the trace information is optional, send none
+func (anonymous *anonymousMechanism) Start() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (anonymous *anonymousMechanism) Next(challenge []byte) ([]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,29 @@
+// XEP 0178 — Best Practices for Use of SASL EXTERNAL with Certificates
+package xmpp
+
+// RFC 4422 # A — The SASL EXTERNAL Mechanism, the identity comes from the
+// TLS client certificate
+type externalMechanism struct {
+	authzid string
+}
+
+func newExternal(credentials *Credentials) Mechanism {
+	if !credentials.ClientCertificate {
+		return nil
+	}
+	return &externalMechanism{authzid: credentials.AuthzID}
+}
+
+func (external *externalMechanism) Name() string {
+	return "EXTERNAL"
+}
+
+// XEP 0178 # 3 — an empty response ("=") asks the server to derive the
+// identity from the certificate
+func (external *externalMechanism) Start() ([]byte, error) {
+	return []byte(external.authzid), nil
+}
+
+func (external *externalMechanism) Next(challenge []byte) ([]byte, error) {
+	return nil, nil
+}
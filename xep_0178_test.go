@@ -0,0 +1,301 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Certificate authority generated for the tests
+type testAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestAuthority(t *testing.T) *testAuthority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testAuthority{cert: cert, key: key, pool: pool}
+}
+
+// Issue a server certificate for a domain, or a client certificate for a JID
+func (ca *testAuthority) issue(t *testing.T, name string, client bool) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Stand-in XMPP server side of one connection
+type testPeer struct {
+	conn    net.Conn
+	decoder *xml.Decoder
+}
+
+func (peer *testPeer) write(data string) error {
+	_, err := peer.conn.Write([]byte(data))
+	return err
+}
+
+// Next element, <stream:stream> is returned without its content
+func (peer *testPeer) next() (xml.StartElement, string, error) {
+	for {
+		token, err := peer.decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, "", err
+		}
+		se, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Local == "stream" {
+			return se, "", nil
+		}
+		var element struct {
+			Inner string `xml:",innerxml"`
+		}
+		if err := peer.decoder.DecodeElement(&element, &se); err != nil {
+			return xml.StartElement{}, "", err
+		}
+		return se, element.Inner, nil
+	}
+}
+
+func testAttr(se xml.StartElement, name string) string {
+	for _, attr := range se.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+const testStreamHeader = `<?xml version='1.0'?><stream:stream xmlns='jabber:client' ` +
+	`xmlns:stream='http://etherx.jabber.org/streams' id='s1' from='example.org' version='1.0'>`
+
+// Stand-in XMPP server for one client
+type testServer struct {
+	// Offered SASL mechanisms
+	mechanisms string
+	direct_tls bool
+	// STARTTLS feature offered in plaintext, empty for none, and the answer
+	// to <starttls/>
+	starttls string
+	answer   string
+}
+
+// Serve one client on the listener: STARTTLS (or direct TLS), SASL with the
+// offered mechanisms, then resource binding. The <auth> element is reported
+// as "mechanism payload" on the returned channel, closed once the client
+// leaves.
+func serveTestClient(listener net.Listener, conf *tls.Config, mechanisms string, direct_tls bool) <-chan string {
+	server := &testServer{
+		mechanisms: mechanisms,
+		direct_tls: direct_tls,
+		starttls:   `<starttls xmlns='` + nsStartTLS + `'><required/></starttls>`,
+		answer:     `<proceed xmlns='` + nsStartTLS + `'/>`,
+	}
+	return server.serve(listener, conf)
+}
+
+func (server *testServer) serve(listener net.Listener, conf *tls.Config) <-chan string {
+	auth := make(chan string, 1)
+	go func() {
+		defer close(auth)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		peer := &testPeer{conn: conn, decoder: xml.NewDecoder(conn)}
+
+		if !server.direct_tls {
+			peer.next()
+			if server.starttls == "" {
+				// Stripped feature list, a client going on sends <auth> in clear
+				peer.write(testStreamHeader + `<stream:features><mechanisms xmlns='` + nsSASL + `'>` +
+					server.mechanisms + `</mechanisms></stream:features>`)
+				if se, payload, err := peer.next(); err == nil && se.Name.Local == "auth" {
+					auth <- testAttr(se, "mechanism") + " " + payload
+				}
+				return
+			}
+			peer.write(testStreamHeader + `<stream:features>` + server.starttls + `</stream:features>`)
+			if _, _, err := peer.next(); err != nil {
+				return
+			}
+			peer.write(server.answer)
+			if !strings.Contains(server.answer, "proceed") {
+				return
+			}
+		}
+		tls_conn := tls.Server(conn, conf)
+		if err := tls_conn.Handshake(); err != nil {
+			return
+		}
+		peer = &testPeer{conn: tls_conn, decoder: xml.NewDecoder(tls_conn)}
+
+		peer.next()
+		peer.write(testStreamHeader + `<stream:features><mechanisms xmlns='` + nsSASL + `'>` + server.mechanisms + `</mechanisms></stream:features>`)
+		se, payload, err := peer.next()
+		if err != nil {
+			return
+		}
+		auth <- testAttr(se, "mechanism") + " " + payload
+		peer.write(`<success xmlns='` + nsSASL + `'/>`)
+
+		peer.next()
+		peer.write(testStreamHeader + `<stream:features><bind xmlns='` + nsBind + `'/></stream:features>`)
+		se, _, err = peer.next()
+		if err != nil {
+			return
+		}
+		peer.write(fmt.Sprintf(`<iq type='result' id='%s'><bind xmlns='%s'><jid>svc@example.org/res</jid></bind></iq>`,
+			testAttr(se, "id"), nsBind))
+
+		// Hold the stream until the client leaves
+		for {
+			if _, _, err := peer.next(); err != nil {
+				return
+			}
+		}
+	}()
+	return auth
+}
+
+func TestExternal(t *testing.T) {
+	ca := newTestAuthority(t)
+	server_conf := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "example.org", false)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	client_cert := ca.issue(t, "svc@example.org", true)
+
+	for _, test := range []struct {
+		name    string
+		authzid string
+		payload string
+	}{
+		{"certificate identity", "", "EXTERNAL ="},
+		{"authorization identity", "other@example.org", "EXTERNAL b3RoZXJAZXhhbXBsZS5vcmc="},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			auth := serveTestClient(listener, server_conf, `<mechanism>EXTERNAL</mechanism>`, false)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			xmpp, err := Dial(ctx, ClientConfig{
+				Domain:       "example.org",
+				Address:      listener.Addr().String(),
+				RootCAs:      ca.pool,
+				Certificates: []tls.Certificate{client_cert},
+				AuthzID:      test.authzid,
+				Resource:     "res",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer xmpp.Close()
+
+			if payload := <-auth; payload != test.payload {
+				t.Errorf("auth = %q, want %q", payload, test.payload)
+			}
+			if xmpp.State.Jid != "svc@example.org/res" {
+				t.Errorf("jid = %q", xmpp.State.Jid)
+			}
+		})
+	}
+}
+
+func TestExternalUntrustedServer(t *testing.T) {
+	ca := newTestAuthority(t)
+	other := newTestAuthority(t)
+	server_conf := &tls.Config{
+		Certificates: []tls.Certificate{other.issue(t, "example.org", false)},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serveTestClient(listener, server_conf, `<mechanism>EXTERNAL</mechanism>`, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = Dial(ctx, ClientConfig{
+		Domain:       "example.org",
+		Address:      listener.Addr().String(),
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, "svc@example.org", true)},
+	})
+	var tls_error *TLSError
+	if !errors.As(err, &tls_error) {
+		t.Fatalf("err = %v, want *TLSError", err)
+	}
+	var verify_error *tls.CertificateVerificationError
+	if !errors.As(err, &verify_error) {
+		t.Errorf("err = %v, want a certificate verification error", err)
+	}
+}
@@ -2,8 +2,11 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"github.com/sirupsen/logrus"
+	"sync/atomic"
 )
 
 // XEP 0198 # 2 — Stream Feature
@@ -24,6 +27,11 @@ type streamMgmtEnabled struct {
 	ID      string   `xml:"id,attr"`
 }
 
+type streamMgmtFailed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 failed"`
+	Any     xml.Name `xml:",any"`
+}
+
 type streamMgmtRequest struct {
 	XMLName xml.Name `xml:"urn:xmpp:sm:3 r"`
 }
@@ -37,56 +45,91 @@ type StreamManagementConfig struct {
 	version  int
 	optional bool
 	state    bool
-	handled  int
-	seq      int
-	window   int
-	input    chan int
-	output   chan int
-	verify   chan int
+	// <enable/> was sent, on its own or inline with Bind 2 (XEP 0386)
+	requested bool
+	// Counters updated by the Read and Write goroutines
+	handled atomic.Uint32
+	seq     atomic.Uint32
+	window  uint32
+	input   chan int
+	output  chan int
+	verify  chan int
+}
+
+// Queue a stream management element, the Write goroutine does not count it
+// as a stanza
+func (xmppconn *XMPPConnection) sendSM(data string) bool {
+	select {
+	case xmppconn.outgoing <- outgoingData{data: data, nonza: true}:
+		return true
+	case <-xmppconn.done:
+		return false
+	}
 }
 
 func (xmppconn *XMPPConnection) SMAnswers() {
 	for {
-		<-xmppconn.State.Sm.input
-		answer := streamMgmtAnswer{Handled: xmppconn.State.Sm.handled}
+		select {
+		case <-xmppconn.State.Sm.input:
+		case <-xmppconn.done:
+			return
+		}
+		handled := xmppconn.State.Sm.handled.Load()
+		answer := streamMgmtAnswer{Handled: int(handled)}
 		output, _ := xml.Marshal(answer)
 
-		logrus.WithFields(logrus.Fields{
-			"h": xmppconn.State.Sm.handled,
+		xmppconn.log.WithFields(logrus.Fields{
+			"h": handled,
 		}).Info("[XEP 0198] Answering to server request")
 
-		xmppconn.writer.WriteString(string(output))
-		xmppconn.writer.Flush()
+		if !xmppconn.sendSM(string(output)) {
+			return
+		}
 	}
 }
 
 func (xmppconn *XMPPConnection) SMRequests() {
+	var requested uint32
 	for {
-		<-xmppconn.State.Sm.output
-		if (xmppconn.State.Sm.seq % xmppconn.State.Sm.window) == 0 {
-			request := streamMgmtRequest{}
-			output, _ := xml.Marshal(request)
-
-			xmppconn.writer.WriteString(string(output))
-			xmppconn.writer.Flush()
-			logrus.WithFields(logrus.Fields{
-				"seq": xmppconn.State.Sm.seq,
-			}).Info("[XEP 0198] Request ACK to server")
+		select {
+		case <-xmppconn.State.Sm.output:
+		case <-xmppconn.done:
+			return
 		}
+		// Ask once every window stanzas, bursts are coalesced
+		seq := xmppconn.State.Sm.seq.Load()
+		if seq/xmppconn.State.Sm.window == requested/xmppconn.State.Sm.window {
+			continue
+		}
+		requested = seq
+		request := streamMgmtRequest{}
+		output, _ := xml.Marshal(request)
+
+		if !xmppconn.sendSM(string(output)) {
+			return
+		}
+		xmppconn.log.WithFields(logrus.Fields{
+			"seq": seq,
+		}).Info("[XEP 0198] Request ACK to server")
 	}
 }
 
 func (xmppconn *XMPPConnection) SMVerify() {
 	for {
-		srv_handled := <-xmppconn.State.Sm.verify
-		logrus.WithFields(logrus.Fields{
+		var srv_handled int
+		select {
+		case srv_handled = <-xmppconn.State.Sm.verify:
+		case <-xmppconn.done:
+			return
+		}
+		xmppconn.log.WithFields(logrus.Fields{
 			"h": srv_handled,
 		}).Info("[XEP 0198] Receiving request from server")
 	}
 }
 
-func (xmppconn *XMPPConnection) StartStreamManagement(resume bool) {
-	logrus.Info("[XEP 0198] Start stream management")
+func (xmppconn *XMPPConnection) StartStreamManagement(ctx context.Context, resume bool) error {
+	xmppconn.log.Info("[XEP 0198] Start stream management")
 
 	var resume_str string
 	if resume {
@@ -96,24 +139,51 @@ func (xmppconn *XMPPConnection) StartStreamManagement(resume bool) {
 	}
 
 	enable := &streamMgmtEnable{Resume: resume_str}
+	xmppconn.State.Sm.requested = true
 	output, _ := xml.Marshal(enable)
 
-	xmppconn.outgoing <- string(output)
-	stream_response := <-xmppconn.incoming
+	if err := xmppconn.send(ctx, string(output)); err != nil {
+		return err
+	}
+	stream_response, err := xmppconn.receive(ctx)
+	if err != nil {
+		return err
+	}
 	switch t := stream_response.Interface.(type) {
 	case *streamMgmtEnabled:
-		logrus.WithFields(logrus.Fields{
-			"id":     t.ID,
-			"resume": resume,
-		}).Info("[XEP 0198] Stream management enabled")
-		xmppconn.State.Sm.state = true
-		xmppconn.State.Sm.window = 5
-		xmppconn.State.Sm.input = make(chan int)
-		xmppconn.State.Sm.output = make(chan int)
-		xmppconn.State.Sm.verify = make(chan int)
-
-		go xmppconn.SMAnswers()
-		go xmppconn.SMRequests()
-		go xmppconn.SMVerify()
+		xmppconn.streamManagementEnabled(t)
+	case *streamMgmtFailed:
+		xmppconn.log.WithFields(logrus.Fields{
+			"condition": t.Any.Local,
+		}).Warn("[XEP 0198] Stream management refused")
+	default:
+		return &StreamError{Err: errors.New("expected stream management <enabled/> or <failed/>")}
 	}
+	return nil
+}
+
+// Stream management is offered and was not requested yet, a refusal is not
+// asked again
+func (xmppconn *XMPPConnection) smEnablePending() bool {
+	sm := xmppconn.State.Sm
+	return sm != nil && sm.version == 3 && !sm.state && !sm.requested
+}
+
+// The server enabled stream management, directly or inline (XEP 0386)
+func (xmppconn *XMPPConnection) streamManagementEnabled(enabled *streamMgmtEnabled) {
+	xmppconn.log.WithFields(logrus.Fields{
+		"id":     enabled.ID,
+		"resume": enabled.Resume,
+	}).Info("[XEP 0198] Stream management enabled")
+	xmppconn.State.Sm.state = true
+	xmppconn.State.Sm.window = 5
+	xmppconn.State.Sm.input = make(chan int)
+	// Notifications from the Write goroutine are coalesced, it never waits
+	xmppconn.State.Sm.output = make(chan int, 1)
+	xmppconn.State.Sm.verify = make(chan int)
+	xmppconn.sm.Store(xmppconn.State.Sm)
+
+	go xmppconn.SMAnswers()
+	go xmppconn.SMRequests()
+	go xmppconn.SMVerify()
 }
@@ -0,0 +1,35 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestStartStreamManagement(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		answer  interface{}
+		enabled bool
+		err     bool
+	}{
+		{"enabled", &streamMgmtEnabled{ID: "sm1", Resume: "true"}, true, false},
+		{"failed", &streamMgmtFailed{}, false, false},
+		{"unexpected stanza", &Message{From: "example.org", Body: "hello"}, false, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			xmpp := testConnection(func(data string) interface{} { return test.answer })
+			defer close(xmpp.done)
+			xmpp.State.Sm = &StreamManagementConfig{version: 3}
+
+			err := xmpp.StartStreamManagement(context.Background(), true)
+			var stream_error *StreamError
+			if test.err != errors.As(err, &stream_error) {
+				t.Fatalf("err = %v", err)
+			}
+			if xmpp.State.Sm.state != test.enabled {
+				t.Errorf("enabled = %v, want %v", xmpp.State.Sm.state, test.enabled)
+			}
+		})
+	}
+}
@@ -2,9 +2,9 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
 	"github.com/sirupsen/logrus"
-	"strconv"
 	"time"
 )
 
@@ -14,40 +14,45 @@ type ping struct {
 }
 
 type PingConfig struct {
-	incoming chan string
+	Latency time.Duration // Round trip time of the last ping
 }
 
-func (xmppconn *XMPPConnection) Ping() {
-	xmppconn.State.Ping = &PingConfig{
-		incoming: make(chan string),
-	}
-
-	id_ping := strconv.FormatUint(uint64(get_cookie()), 10)
-	iq_ping := &clientIQ{
+func (xmppconn *XMPPConnection) Ping(ctx context.Context) error {
+	iq_ping := &IQ{
 		Type: "get",
-		ID:   id_ping,
 		From: xmppconn.State.Jid,
 		Ping: &ping{},
 	}
-	output, _ := xml.Marshal(iq_ping)
-	xmppconn.outgoing <- string(output)
-	logrus.WithFields(logrus.Fields{
-		"id": id_ping,
-	}).Info("[XEP 0199] Ping")
-	for {
-		ping_id := <-xmppconn.State.Ping.incoming
-		if ping_id == id_ping {
-			logrus.WithFields(logrus.Fields{
-				"id": ping_id,
-			}).Info("[XEP 0199] Pong")
-			return
-		}
+	sent := time.Now()
+	xmppconn.log.Info("[XEP 0199] Ping")
+	response, err := xmppconn.SendIQ(ctx, iq_ping)
+	if err != nil {
+		return err
 	}
+	latency := time.Since(sent)
+	xmppconn.log.WithFields(logrus.Fields{
+		"id":      response.ID,
+		"latency": latency,
+	}).Info("[XEP 0199] Pong")
+	xmppconn.State.Ping = &PingConfig{Latency: latency}
+	return nil
 }
 
-func (xmppconn *XMPPConnection) InfinitePing() {
+// XEP 0199 # 4.2 — Answer pings from the server or other entities
+func handlePing(xmppconn *XMPPConnection, iq *IQ) {
+	xmppconn.Send(context.Background(), iq.Result())
+}
+
+// Ping the server every two seconds until the context is done or a ping fails
+func (xmppconn *XMPPConnection) InfinitePing(ctx context.Context) error {
 	for {
-		xmppconn.Ping()
-		time.Sleep(2 * time.Second)
+		if err := xmppconn.Ping(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
@@ -0,0 +1,10 @@
+// XEP 0280 — Message Carbons
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+type carbonsEnable struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 enable"`
+}
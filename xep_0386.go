@@ -0,0 +1,112 @@
+// XEP 0386 — Bind 2
+package xmpp
+
+import (
+	"encoding/xml"
+	"github.com/sirupsen/logrus"
+	"strings"
+)
+
+// Bind2Config asks to bind the resource within SASL 2 authentication, along
+// with inline features, saving the round trips of a new stream, Bind and
+// stream management
+type Bind2Config struct {
+	// Tag names the client, the server builds the resource from it
+	Tag string
+	// Carbons enables Message Carbons (XEP 0280)
+	Carbons bool
+	// StreamManagement enables resumable Stream Management (XEP 0198)
+	StreamManagement bool
+	// Extensions are added to the request for other inline features
+	Extensions []Extension
+}
+
+// XEP 0388 — inline features of the SASL 2 stream feature
+type sasl2Inline struct {
+	Bind *bind2Feature `xml:"urn:xmpp:bind:0 bind"`
+	Fast *fastFeature  `xml:"urn:xmpp:fast:0 fast"` // XEP 0484
+}
+
+type bind2Feature struct {
+	XMLName  xml.Name `xml:"urn:xmpp:bind:0 bind"`
+	Features []struct {
+		Var string `xml:"var,attr"`
+	} `xml:"inline>feature"`
+}
+
+// Whether the feature can be enabled inline
+func (feature *bind2Feature) inline(namespace string) bool {
+	for _, f := range feature.Features {
+		if f.Var == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+type bind2Bind struct {
+	XMLName    xml.Name          `xml:"urn:xmpp:bind:0 bind"`
+	Tag        string            `xml:"tag,omitempty"`
+	Carbons    *carbonsEnable    `xml:"urn:xmpp:carbons:2 enable"`
+	Sm         *streamMgmtEnable `xml:"urn:xmpp:sm:3 enable"`
+	Extensions []Extension       `xml:",any"`
+}
+
+type bind2Bound struct {
+	XMLName   xml.Name           `xml:"urn:xmpp:bind:0 bound"`
+	SmEnabled *streamMgmtEnabled `xml:"urn:xmpp:sm:3 enabled"`
+	SmFailed  *streamMgmtFailed  `xml:"urn:xmpp:sm:3 failed"`
+}
+
+// Build the bind request for the authenticate element, nil when the server
+// does not offer Bind 2 or it is not configured
+func (xmpp *XMPPConnection) bind2Request() *bind2Bind {
+	config := xmpp.config.Bind2
+	authentication := xmpp.features.Authentication
+	if config == nil || authentication.Inline == nil || authentication.Inline.Bind == nil {
+		return nil
+	}
+	feature := authentication.Inline.Bind
+
+	request := &bind2Bind{
+		Tag:        config.Tag,
+		Extensions: config.Extensions,
+	}
+	if config.Carbons && feature.inline(nsCarbons) {
+		request.Carbons = &carbonsEnable{}
+	}
+	if config.StreamManagement && feature.inline(nsStreamMgmt) {
+		request.Sm = &streamMgmtEnable{Resume: "true"}
+	}
+	return request
+}
+
+// Apply the result of the inline bind, once the new features are known
+func (xmpp *XMPPConnection) bind2Bound(request *bind2Bind, bound *bind2Bound, jid string) {
+	xmpp.State.Auth.Bound = true
+	xmpp.State.Jid = jid
+	if i := strings.Index(jid, "/"); i >= 0 {
+		xmpp.State.Resource = jid[i+1:]
+	}
+	xmpp.State.Carbons = request.Carbons != nil
+	xmpp.log.WithFields(logrus.Fields{
+		"jid":     jid,
+		"carbons": xmpp.State.Carbons,
+	}).Info("[XEP 0386] Bound")
+
+	if request.Sm == nil {
+		return
+	}
+	if xmpp.State.Sm == nil {
+		xmpp.State.Sm = &StreamManagementConfig{version: 3}
+	}
+	xmpp.State.Sm.requested = true
+	switch {
+	case bound.SmEnabled != nil:
+		xmpp.streamManagementEnabled(bound.SmEnabled)
+	case bound.SmFailed != nil:
+		xmpp.log.WithFields(logrus.Fields{
+			"condition": bound.SmFailed.Any.Local,
+		}).Warn("[XEP 0198] Stream management refused")
+	}
+}
@@ -0,0 +1,62 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestBind2Bound(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		sm     bool
+		bound  bind2Bound
+		state  bool
+		legacy bool
+	}{
+		{"sm enabled", true, bind2Bound{SmEnabled: &streamMgmtEnabled{ID: "sm1", Resume: "true"}}, true, false},
+		{"sm failed", true, bind2Bound{SmFailed: &streamMgmtFailed{Any: xml.Name{Space: nsStanzas, Local: "unexpected-request"}}}, false, false},
+		// Stream management is left to the legacy <enable/>
+		{"sm not inline", false, bind2Bound{}, false, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var authenticate string
+			xmpp := testConnection(func(data string) interface{} {
+				authenticate = data
+				return []interface{}{
+					&sasl2Success{AuthorizationIdentifier: "user@example.org/client.Xyz", Bound: &test.bound},
+					&streamFeatures{Sms: []*streamMgmtSm{{XMLName: xml.Name{Space: nsStreamMgmt, Local: "sm"}}}},
+				}
+			})
+			defer close(xmpp.done)
+			xmpp.config.Bind2 = &Bind2Config{Tag: "client", Carbons: true, StreamManagement: test.sm}
+			xmpp.features = &streamFeatures{Authentication: &sasl2Authentication{
+				Mechanism: []string{"PLAIN"},
+				Inline: &sasl2Inline{Bind: &bind2Feature{Features: []struct {
+					Var string `xml:"var,attr"`
+				}{{nsCarbons}, {nsStreamMgmt}}}},
+			}}
+
+			credentials := &Credentials{Account: "user@example.org", Password: "secret"}
+			if err := xmpp.authenticateSasl2(context.Background(), newMechanism("PLAIN", credentials), credentials); err != nil {
+				t.Fatal(err)
+			}
+			if test.sm != strings.Contains(authenticate, `<enable xmlns="`+nsStreamMgmt+`" resume="true">`) {
+				t.Errorf("authenticate = %s, inline sm %v", authenticate, test.sm)
+			}
+			if !xmpp.State.Auth.Bound || xmpp.State.Jid != "user@example.org/client.Xyz" || xmpp.State.Resource != "client.Xyz" {
+				t.Errorf("bound %v as %q resource %q", xmpp.State.Auth.Bound, xmpp.State.Jid, xmpp.State.Resource)
+			}
+			if !xmpp.State.Carbons {
+				t.Error("carbons not enabled")
+			}
+			if xmpp.State.Sm.state != test.state {
+				t.Errorf("sm enabled = %v, want %v", xmpp.State.Sm.state, test.state)
+			}
+			if pending := xmpp.smEnablePending(); pending != test.legacy {
+				t.Errorf("legacy enable pending = %v, want %v", pending, test.legacy)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+// XEP 0388 — Extensible SASL Profile
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Task is a SASL 2 step run after the mechanism when the server answers
+// with <continue/>, such as a second factor or a credential upgrade
+type Task interface {
+	Name() string
+	// Start receives the additional data of <continue/> and returns the
+	// inner XML of the first <task-data/>, nil to send none
+	Start(additional_data []byte) ([]byte, error)
+	// Next receives the inner XML of a <task-data/> sent by the server and
+	// returns the inner XML of the answer, nil to send none
+	Next(task_data []byte) ([]byte, error)
+}
+
+// AuthConfig describes the completed authentication
+type AuthConfig struct {
+	Mechanism string
+	// Negotiated with SASL 2
+	Sasl2 bool
+	// Additional data of the success, already verified by the mechanism
+	AdditionalData []byte
+	// SASL 2 — JID the stream is authorized as
+	AuthorizationIdentifier string
+	// XEP 0386 — the resource was bound inline
+	Bound bool
+}
+
+// UserAgent identifies the client, ID should be a stable UUID for this
+// installation
+type UserAgent struct {
+	XMLName  xml.Name `xml:"user-agent"`
+	ID       string   `xml:"id,attr,omitempty"`
+	Software string   `xml:"software,omitempty"`
+	Device   string   `xml:"device,omitempty"`
+}
+
+type sasl2Authentication struct {
+	XMLName   xml.Name     `xml:"urn:xmpp:sasl:2 authentication"`
+	Mechanism []string     `xml:"mechanism"`
+	Inline    *sasl2Inline `xml:"inline"`
+}
+
+type sasl2Authenticate struct {
+	XMLName         xml.Name   `xml:"urn:xmpp:sasl:2 authenticate"`
+	Mechanism       string     `xml:"mechanism,attr"`
+	InitialResponse *string    `xml:"initial-response"`
+	UserAgent       *UserAgent `xml:"user-agent"`
+	Bind            *bind2Bind `xml:"urn:xmpp:bind:0 bind"` // XEP 0386
+
+	RequestToken *fastRequestToken `xml:"urn:xmpp:fast:0 request-token"` // XEP 0484
+	Fast         *fastAuthenticate `xml:"urn:xmpp:fast:0 fast"`          // XEP 0484
+}
+
+type sasl2Challenge struct {
+	XMLName xml.Name `xml:"urn:xmpp:sasl:2 challenge"`
+	Data    string   `xml:",chardata"`
+}
+
+type sasl2Response struct {
+	XMLName xml.Name `xml:"urn:xmpp:sasl:2 response"`
+	Data    string   `xml:",chardata"`
+}
+
+type sasl2Abort struct {
+	XMLName xml.Name `xml:"urn:xmpp:sasl:2 abort"`
+	Text    string   `xml:"text,omitempty"`
+}
+
+type sasl2Continue struct {
+	XMLName        xml.Name `xml:"urn:xmpp:sasl:2 continue"`
+	AdditionalData string   `xml:"additional-data"`
+	Tasks          []string `xml:"tasks>task"`
+	Text           string   `xml:"text"`
+}
+
+type sasl2Next struct {
+	XMLName xml.Name `xml:"urn:xmpp:sasl:2 next"`
+	Task    string   `xml:"task,attr"`
+	Data    []byte   `xml:",innerxml"`
+}
+
+type sasl2TaskData struct {
+	XMLName xml.Name `xml:"urn:xmpp:sasl:2 task-data"`
+	Data    []byte   `xml:",innerxml"`
+}
+
+type sasl2Success struct {
+	XMLName                 xml.Name    `xml:"urn:xmpp:sasl:2 success"`
+	AdditionalData          string      `xml:"additional-data"`
+	AuthorizationIdentifier string      `xml:"authorization-identifier"`
+	Bound                   *bind2Bound `xml:"urn:xmpp:bind:0 bound"` // XEP 0386
+	Token                   *fastToken  `xml:"urn:xmpp:fast:0 token"` // XEP 0484
+	Extensions              []Extension `xml:",any"`
+}
+
+type sasl2Failure struct {
+	XMLName  xml.Name    `xml:"urn:xmpp:sasl:2 failure"`
+	Text     string      `xml:"text"`
+	Elements []Extension `xml:",any"`
+}
+
+// Defined condition, in the SASL namespace
+func (failure *sasl2Failure) condition() string {
+	for _, element := range failure.Elements {
+		if element.XMLName.Space == nsSASL {
+			return element.XMLName.Local
+		}
+	}
+	return ""
+}
+
+func (xmpp *XMPPConnection) selectTask(offered []string) Task {
+	for _, task := range xmpp.config.Tasks {
+		for _, name := range offered {
+			if task.Name() == name {
+				return task
+			}
+		}
+	}
+	return nil
+}
+
+// Exchange with the server until success or failure. Unlike SASL, the stream
+// is not restarted, the server sends the new features right away.
+func (xmpp *XMPPConnection) authenticateSasl2(ctx context.Context, mechanism Mechanism, credentials *Credentials) error {
+	mechanism_name := mechanism.Name()
+	xmpp.log.WithFields(logrus.Fields{
+		"account":   credentials.Account,
+		"mechanism": mechanism_name,
+	}).Info("[XEP 0388] Authentication")
+
+	initial, err := mechanism.Start()
+	if err != nil {
+		return &AuthError{Mechanism: mechanism_name, Err: err}
+	}
+	authenticate := &sasl2Authenticate{
+		Mechanism: mechanism_name,
+		UserAgent: xmpp.config.UserAgent,
+		Bind:      xmpp.bind2Request(),
+	}
+	if initial != nil {
+		initial_response := sasl_encode(initial)
+		authenticate.InitialResponse = &initial_response
+	}
+	xmpp.fastRequest(authenticate, mechanism, credentials)
+	output, _ := xml.Marshal(authenticate)
+	if err := xmpp.send(ctx, string(output)); err != nil {
+		return &AuthError{Mechanism: mechanism_name, Err: err}
+	}
+
+	// Once the server asks to continue, the mechanism is done
+	var task Task
+	abort := func(err error) error {
+		output, _ := xml.Marshal(&sasl2Abort{})
+		xmpp.send(ctx, string(output))
+		return &AuthError{Mechanism: mechanism_name, Err: err}
+	}
+
+	for {
+		auth_result, err := xmpp.receive(ctx)
+		if err != nil {
+			return &AuthError{Mechanism: mechanism_name, Err: err}
+		}
+
+		switch t := auth_result.Interface.(type) {
+		case *sasl2Challenge:
+			challenge, err := sasl_decode(t.Data)
+			if err != nil {
+				return abort(err)
+			}
+			response, err := mechanism.Next(challenge)
+			if err != nil {
+				return abort(err)
+			}
+			output, _ := xml.Marshal(&sasl2Response{Data: sasl_encode(response)})
+			if err := xmpp.send(ctx, string(output)); err != nil {
+				return &AuthError{Mechanism: mechanism_name, Err: err}
+			}
+
+		case *sasl2Continue:
+			data, err := sasl_decode(t.AdditionalData)
+			if err == nil && task == nil {
+				_, err = mechanism.Next(data)
+			}
+			if err != nil {
+				return abort(err)
+			}
+			task = xmpp.selectTask(t.Tasks)
+			if task == nil {
+				return abort(errors.New("no supported SASL 2 task"))
+			}
+			xmpp.log.WithField("task", task.Name()).Info("[XEP 0388] Continue")
+			task_data, err := task.Start(data)
+			if err != nil {
+				return abort(err)
+			}
+			output, _ := xml.Marshal(&sasl2Next{Task: task.Name(), Data: task_data})
+			if err := xmpp.send(ctx, string(output)); err != nil {
+				return &AuthError{Mechanism: mechanism_name, Err: err}
+			}
+
+		case *sasl2TaskData:
+			if task == nil {
+				return abort(errors.New("unexpected task data"))
+			}
+			task_data, err := task.Next(t.Data)
+			if err != nil {
+				return abort(err)
+			}
+			if task_data != nil {
+				output, _ := xml.Marshal(&sasl2TaskData{Data: task_data})
+				if err := xmpp.send(ctx, string(output)); err != nil {
+					return &AuthError{Mechanism: mechanism_name, Err: err}
+				}
+			}
+
+		case *sasl2Success:
+			// Additional data with success is the last server message
+			data, err := sasl_decode(t.AdditionalData)
+			if err == nil && task == nil {
+				_, err = mechanism.Next(data)
+			}
+			if err != nil {
+				return &AuthError{Mechanism: mechanism_name, Err: err}
+			}
+			xmpp.State.Auth = &AuthConfig{
+				Mechanism:               mechanism_name,
+				Sasl2:                   true,
+				AdditionalData:          data,
+				AuthorizationIdentifier: t.AuthorizationIdentifier,
+			}
+			xmpp.log.WithField("jid", t.AuthorizationIdentifier).Info("[XEP 0388] Authenticated")
+			xmpp.fastSuccess(authenticate, t.Token)
+			if err := xmpp.awaitFeatures(ctx); err != nil {
+				return err
+			}
+			if authenticate.Bind != nil && t.Bound != nil {
+				xmpp.bind2Bound(authenticate.Bind, t.Bound, t.AuthorizationIdentifier)
+			}
+			return nil
+
+		case *sasl2Failure:
+			condition := t.condition()
+			xmpp.log.Error("[XEP 0388] Authentication failure : " + condition + " " + t.Text)
+			return &AuthError{
+				Mechanism: mechanism_name,
+				Condition: condition,
+				Text:      t.Text,
+				Err:       saslConditions[condition],
+			}
+
+		default:
+			return abort(errors.New("unexpected response"))
+		}
+	}
+}
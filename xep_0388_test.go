@@ -0,0 +1,198 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"testing"
+)
+
+// Element sent by the client
+func testSent(data string) Extension {
+	var element Extension
+	xml.Unmarshal([]byte(data), &element)
+	return element
+}
+
+func TestSasl2Success(t *testing.T) {
+	vector := scramVectors[1]
+	for _, test := range []struct {
+		name         string
+		server_final string
+		err          bool
+	}{
+		{"verified", vector.server_final, false},
+		{"tampered additional data", "v=AAriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", true},
+		{"no additional data", "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var sent []string
+			xmpp := testConnection(func(data string) interface{} {
+				element := testSent(data)
+				sent = append(sent, element.XMLName.Local)
+				switch element.XMLName.Local {
+				case "authenticate":
+					return &sasl2Challenge{Data: base64.StdEncoding.EncodeToString([]byte(vector.server_first))}
+				case "response":
+					return []interface{}{
+						&sasl2Success{
+							AdditionalData:          base64.StdEncoding.EncodeToString([]byte(test.server_final)),
+							AuthorizationIdentifier: "user@example.org",
+						},
+						&streamFeatures{},
+					}
+				}
+				return nil
+			})
+			defer close(xmpp.done)
+			xmpp.features = &streamFeatures{Authentication: &sasl2Authentication{Mechanism: []string{vector.name}}}
+
+			credentials := &Credentials{Account: "user@example.org", Password: "pencil"}
+			err := xmpp.authenticateSasl2(context.Background(), testScram(vector.name, vector.nonce), credentials)
+			if test.err {
+				var auth_error *AuthError
+				if !errors.As(err, &auth_error) {
+					t.Fatalf("err = %v, want *AuthError", err)
+				}
+				if xmpp.State.Auth != nil {
+					t.Error("authenticated")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth := xmpp.State.Auth
+			if auth == nil || !auth.Sasl2 || auth.Mechanism != vector.name || auth.AuthorizationIdentifier != "user@example.org" {
+				t.Errorf("auth = %+v", auth)
+			}
+			if string(auth.AdditionalData) != vector.server_final {
+				t.Errorf("additional data = %q", auth.AdditionalData)
+			}
+			if len(sent) != 2 {
+				t.Errorf("sent %v, want authenticate and response", sent)
+			}
+		})
+	}
+}
+
+// Task recording what the server sends, answering <answer/>
+type testTask struct {
+	started  []byte
+	received []byte
+}
+
+func (task *testTask) Name() string {
+	return "TEST-TASK"
+}
+
+func (task *testTask) Start(additional_data []byte) ([]byte, error) {
+	task.started = additional_data
+	return []byte("<start/>"), nil
+}
+
+func (task *testTask) Next(task_data []byte) ([]byte, error) {
+	task.received = task_data
+	return []byte("<answer/>"), nil
+}
+
+func TestSasl2Continue(t *testing.T) {
+	task := &testTask{}
+	var next, task_data Extension
+	xmpp := testConnection(func(data string) interface{} {
+		element := testSent(data)
+		switch element.XMLName.Local {
+		case "authenticate":
+			return &sasl2Continue{
+				AdditionalData: base64.StdEncoding.EncodeToString([]byte("continue data")),
+				Tasks:          []string{"OTHER-TASK", "TEST-TASK"},
+			}
+		case "next":
+			next = element
+			return &sasl2TaskData{Data: []byte("<challenge/>")}
+		case "task-data":
+			task_data = element
+			return []interface{}{
+				&sasl2Success{AuthorizationIdentifier: "user@example.org"},
+				&streamFeatures{},
+			}
+		}
+		return nil
+	})
+	defer close(xmpp.done)
+	xmpp.features = &streamFeatures{Authentication: &sasl2Authentication{Mechanism: []string{"PLAIN"}}}
+	xmpp.config.Tasks = []Task{task}
+
+	credentials := &Credentials{Account: "user@example.org", Password: "secret"}
+	err := xmpp.authenticateSasl2(context.Background(), newMechanism("PLAIN", credentials), credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(task.started) != "continue data" {
+		t.Errorf("task started with %q", task.started)
+	}
+	if testAttr(xml.StartElement{Attr: next.Attrs}, "task") != "TEST-TASK" || string(next.Inner) != "<start/>" {
+		t.Errorf("next = %+v", next)
+	}
+	if string(task.received) != "<challenge/>" {
+		t.Errorf("task received %q", task.received)
+	}
+	if string(task_data.Inner) != "<answer/>" {
+		t.Errorf("task-data = %q", task_data.Inner)
+	}
+	if xmpp.State.Auth == nil || xmpp.State.Auth.AuthorizationIdentifier != "user@example.org" {
+		t.Errorf("auth = %+v", xmpp.State.Auth)
+	}
+}
+
+func TestSasl2Failure(t *testing.T) {
+	for condition, want := range saslConditions {
+		t.Run(condition, func(t *testing.T) {
+			xmpp := testConnection(func(data string) interface{} {
+				return &sasl2Failure{
+					Text:     "go away",
+					Elements: []Extension{{XMLName: xml.Name{Space: nsSASL, Local: condition}}},
+				}
+			})
+			defer close(xmpp.done)
+			xmpp.features = &streamFeatures{Authentication: &sasl2Authentication{Mechanism: []string{"PLAIN"}}}
+
+			credentials := &Credentials{Account: "user@example.org", Password: "secret"}
+			err := xmpp.authenticateSasl2(context.Background(), newMechanism("PLAIN", credentials), credentials)
+			var auth_error *AuthError
+			if !errors.As(err, &auth_error) {
+				t.Fatalf("err = %v, want *AuthError", err)
+			}
+			if auth_error.Condition != condition || auth_error.Text != "go away" || !errors.Is(err, want) {
+				t.Errorf("err = %+v, want %s", auth_error, condition)
+			}
+		})
+	}
+}
+
+func TestSasl2Fallback(t *testing.T) {
+	sent := make(chan Extension, 1)
+	xmpp := testConnection(func(data string) interface{} {
+		sent <- testSent(data)
+		return &saslFailure{Any: xml.Name{Space: nsSASL, Local: "not-authorized"}}
+	})
+	defer close(xmpp.done)
+	// PLAIN is refused in clear, SCRAM is only offered with SASL
+	xmpp.features = &streamFeatures{
+		Authentication: &sasl2Authentication{Mechanism: []string{"PLAIN"}},
+		Mechanisms:     &saslMechanisms{Mechanism: []string{"PLAIN", "SCRAM-SHA-256"}},
+	}
+
+	err := xmpp.AuthenticateUser(context.Background(), "user@example.org", "secret", "example.org")
+	if !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("err = %v, want %v", err, ErrNotAuthorized)
+	}
+	auth := <-sent
+	if auth.XMLName.Space != nsSASL || auth.XMLName.Local != "auth" {
+		t.Errorf("sent %v, want the SASL <auth>", auth.XMLName)
+	}
+	if mechanism := testAttr(xml.StartElement{Attr: auth.Attrs}, "mechanism"); mechanism != "SCRAM-SHA-256" {
+		t.Errorf("mechanism = %s, want SCRAM-SHA-256", mechanism)
+	}
+}
@@ -0,0 +1,90 @@
+// XEP 0440 — SASL Channel-Binding Type Capability
+// RFC 5929 — Channel Bindings for TLS
+// RFC 9266 — Channel Bindings for TLS 1.3
+package xmpp
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+)
+
+type saslChannelBinding struct {
+	XMLName xml.Name `xml:"urn:xmpp:sasl-cb:0 sasl-channel-binding"`
+	Types   []struct {
+		Type string `xml:"type,attr"`
+	} `xml:"channel-binding"`
+}
+
+// Channel binding types, preferred first. tls-unique is not defined for
+// TLS 1.3 and Go does not expose it, it is never used.
+var channelBindingTypes = []string{
+	"tls-exporter",
+	"tls-server-end-point",
+}
+
+// Choose the channel binding type for this TLS session. Without the XEP 0440
+// feature, the server is assumed to support the type matching the TLS version.
+func select_channel_binding(state *tls.ConnectionState, offered *saslChannelBinding) string {
+	for _, binding_type := range channelBindingTypes {
+		// RFC 9266 # 2 — tls-exporter requires TLS 1.3 (or extended master
+		// secret, which Go does not report)
+		if binding_type == "tls-exporter" && state.Version < tls.VersionTLS13 {
+			continue
+		}
+		if binding_type == "tls-server-end-point" && len(state.PeerCertificates) == 0 {
+			continue
+		}
+		if offered == nil {
+			if binding_type == "tls-exporter" || state.Version < tls.VersionTLS13 {
+				return binding_type
+			}
+			continue
+		}
+		for _, t := range offered.Types {
+			if t.Type == binding_type {
+				return binding_type
+			}
+		}
+	}
+	return ""
+}
+
+func channel_binding_data(state *tls.ConnectionState, binding_type string) ([]byte, error) {
+	switch binding_type {
+	case "tls-exporter":
+		// RFC 9266 # 2 — 32 bytes, empty context
+		return state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	case "tls-server-end-point":
+		return tls_server_end_point(state)
+	}
+	return nil, errors.New("unsupported channel binding type " + binding_type)
+}
+
+// RFC 5929 # 4.1 — hash of the server certificate with the hash of its
+// signature algorithm, SHA-256 replaces MD5 and SHA-1
+func tls_server_end_point(state *tls.ConnectionState) ([]byte, error) {
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("no server certificate")
+	}
+	cert := state.PeerCertificates[0]
+
+	var hash crypto.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.DSAWithSHA256, x509.ECDSAWithSHA256:
+		hash = crypto.SHA256
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		hash = crypto.SHA512
+	default:
+		return nil, errors.New("no tls-server-end-point hash for " + cert.SignatureAlgorithm.String())
+	}
+
+	h := hash.New()
+	h.Write(cert.Raw)
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,159 @@
+package xmpp
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScramChannelBinding(t *testing.T) {
+	binding := []byte("binding data")
+	for _, test := range []struct {
+		name         string
+		mechanism    string
+		binding_type string
+		server_plus  bool
+		header       string
+		// Channel binding data after the header in c=
+		data []byte
+	}{
+		{"bound", "SCRAM-SHA-256-PLUS", "tls-exporter", true, "p=tls-exporter,,", binding},
+		{"bound end point", "SCRAM-SHA-256-PLUS", "tls-server-end-point", true, "p=tls-server-end-point,,", binding},
+		// RFC 5802 # 6 — -PLUS stripped from the offer, the server detects it
+		{"supported, not offered", "SCRAM-SHA-256", "tls-exporter", false, "y,,", nil},
+		{"supported, not chosen", "SCRAM-SHA-256", "tls-exporter", true, "n,,", nil},
+		{"unsupported", "SCRAM-SHA-256", "", false, "n,,", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			credentials := &Credentials{
+				Account:            "user@example.org",
+				Password:           "pencil",
+				ChannelBindingType: test.binding_type,
+				ServerPlus:         test.server_plus,
+			}
+			if test.binding_type != "" {
+				credentials.ChannelBinding = binding
+			}
+			mechanism := newMechanism(test.mechanism, credentials)
+			if mechanism == nil {
+				t.Fatal("mechanism unusable")
+			}
+			scram := mechanism.(*scramMechanism)
+			scram.client_nonce = "rOprNGfwEbeRWgbNEkqO"
+
+			client_first, err := scram.Start()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(client_first), test.header+"n=user,") {
+				t.Errorf("client-first = %q, want the %q header", client_first, test.header)
+			}
+			client_final, err := scram.Next([]byte(scramVectors[1].server_first))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := base64.StdEncoding.EncodeToString(append([]byte(test.header), test.data...))
+			if !strings.HasPrefix(string(client_final), "c="+c+",") {
+				t.Errorf("client-final = %q, want c=%s", client_final, c)
+			}
+		})
+	}
+
+	// Without binding data, -PLUS is not usable
+	if newMechanism("SCRAM-SHA-256-PLUS", &Credentials{Account: "user@example.org"}) != nil {
+		t.Error("SCRAM-SHA-256-PLUS usable without channel binding")
+	}
+}
+
+func testChannelBindingFeature(t *testing.T, types ...string) *saslChannelBinding {
+	t.Helper()
+	data := `<sasl-channel-binding xmlns='urn:xmpp:sasl-cb:0'>`
+	for _, binding_type := range types {
+		data += `<channel-binding type='` + binding_type + `'/>`
+	}
+	var feature saslChannelBinding
+	if err := xml.Unmarshal([]byte(data+`</sasl-channel-binding>`), &feature); err != nil {
+		t.Fatal(err)
+	}
+	return &feature
+}
+
+func TestSelectChannelBinding(t *testing.T) {
+	certificates := []*x509.Certificate{{Raw: []byte("certificate")}}
+	tls12 := &tls.ConnectionState{Version: tls.VersionTLS12, PeerCertificates: certificates}
+	tls13 := &tls.ConnectionState{Version: tls.VersionTLS13, PeerCertificates: certificates}
+	no_certificate := &tls.ConnectionState{Version: tls.VersionTLS12}
+
+	for _, test := range []struct {
+		name    string
+		state   *tls.ConnectionState
+		offered *saslChannelBinding
+		want    string
+	}{
+		{"TLS 1.3", tls13, nil, "tls-exporter"},
+		{"TLS 1.2", tls12, nil, "tls-server-end-point"},
+		{"TLS 1.2 without certificate", no_certificate, nil, ""},
+		{"TLS 1.3 both offered", tls13, testChannelBindingFeature(t, "tls-server-end-point", "tls-exporter"), "tls-exporter"},
+		{"TLS 1.3 end point offered", tls13, testChannelBindingFeature(t, "tls-server-end-point"), "tls-server-end-point"},
+		{"TLS 1.2 both offered", tls12, testChannelBindingFeature(t, "tls-exporter", "tls-server-end-point"), "tls-server-end-point"},
+		{"TLS 1.2 exporter offered", tls12, testChannelBindingFeature(t, "tls-exporter"), ""},
+		{"tls-unique offered", tls12, testChannelBindingFeature(t, "tls-unique"), ""},
+		{"none offered", tls13, testChannelBindingFeature(t), ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if binding_type := select_channel_binding(test.state, test.offered); binding_type != test.want {
+				t.Errorf("channel binding = %q, want %q", binding_type, test.want)
+			}
+		})
+	}
+}
+
+func TestTLSServerEndPoint(t *testing.T) {
+	raw := []byte("certificate")
+	sha256_hash := sha256.Sum256(raw)
+	sha384_hash := sha512.Sum384(raw)
+	sha512_hash := sha512.Sum512(raw)
+
+	for _, test := range []struct {
+		name      string
+		algorithm x509.SignatureAlgorithm
+		want      []byte
+	}{
+		// RFC 5929 # 4.1 — MD5 and SHA-1 are replaced by SHA-256
+		{"MD5", x509.MD5WithRSA, sha256_hash[:]},
+		{"SHA-1", x509.ECDSAWithSHA1, sha256_hash[:]},
+		{"SHA-256", x509.ECDSAWithSHA256, sha256_hash[:]},
+		{"SHA-384", x509.SHA384WithRSAPSS, sha384_hash[:]},
+		{"SHA-512", x509.ECDSAWithSHA512, sha512_hash[:]},
+		{"Ed25519", x509.PureEd25519, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+				{Raw: raw, SignatureAlgorithm: test.algorithm},
+			}}
+			data, err := tls_server_end_point(state)
+			if test.want == nil {
+				if err == nil {
+					t.Errorf("hash %x, want an error", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(data, test.want) {
+				t.Errorf("hash = %x, want %x", data, test.want)
+			}
+		})
+	}
+
+	if _, err := tls_server_end_point(&tls.ConnectionState{}); err == nil {
+		t.Error("hash without a server certificate")
+	}
+}
@@ -0,0 +1,277 @@
+// XEP 0484 — Fast Authentication Streamlining Tokens
+package xmpp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// FastConfig enables FAST: a token is requested when logging in with the
+// password, later logins use it instead. ClientConfig.UserAgent must carry
+// an ID, tokens are bound to it. TLS 1.3 early data (0-RTT) is never used,
+// crypto/tls can not send it.
+type FastConfig struct {
+	Store TokenStore
+	// Invalidate logs in with the token one last time and asks the server
+	// to revoke it
+	Invalidate bool
+}
+
+// FastToken is a token issued by the server
+type FastToken struct {
+	Mechanism string    `json:"mechanism"`
+	Token     string    `json:"token"`
+	Expiry    time.Time `json:"expiry"`
+	// Count of logins with the token, it protects against replays
+	Count uint32 `json:"count"`
+}
+
+// HT mechanisms usable for FAST, strongest first
+var fastMechanisms = []string{
+	"HT-SHA-256-EXPR",
+	"HT-SHA-256-ENDP",
+	"HT-SHA-256-NONE",
+}
+
+type fastFeature struct {
+	XMLName   xml.Name `xml:"urn:xmpp:fast:0 fast"`
+	Mechanism []string `xml:"mechanism"`
+}
+
+type fastRequestToken struct {
+	XMLName   xml.Name `xml:"urn:xmpp:fast:0 request-token"`
+	Mechanism string   `xml:"mechanism,attr"`
+}
+
+type fastAuthenticate struct {
+	XMLName    xml.Name `xml:"urn:xmpp:fast:0 fast"`
+	Count      uint32   `xml:"count,attr"`
+	Invalidate bool     `xml:"invalidate,attr,omitempty"`
+}
+
+type fastToken struct {
+	XMLName xml.Name `xml:"urn:xmpp:fast:0 token"`
+	Expiry  string   `xml:"expiry,attr"`
+	Token   string   `xml:"token,attr"`
+}
+
+// Hashed Token SASL mechanism (draft-schmaus-kitten-sasl-ht), the channel
+// binding is chosen by the name suffix
+type htMechanism struct {
+	name            string
+	username        string
+	token           *FastToken
+	channel_binding []byte
+	verified        bool
+}
+
+func ht_binding_type(name string) string {
+	switch {
+	case strings.HasSuffix(name, "-EXPR"):
+		return "tls-exporter"
+	case strings.HasSuffix(name, "-ENDP"):
+		return "tls-server-end-point"
+	}
+	return ""
+}
+
+func newHT(name string, credentials *Credentials, token *FastToken) (*htMechanism, error) {
+	if !strings.HasPrefix(name, "HT-SHA-256-") {
+		return nil, errors.New("unsupported FAST mechanism " + name)
+	}
+	var channel_binding []byte
+	if binding_type := ht_binding_type(name); binding_type != "" {
+		if credentials.TLS == nil {
+			return nil, errors.New("no TLS session to bind")
+		}
+		data, err := channel_binding_data(credentials.TLS, binding_type)
+		if err != nil {
+			return nil, err
+		}
+		channel_binding = data
+	}
+
+	return &htMechanism{
+		name:            name,
+		username:        jid_localpart(credentials.Account),
+		token:           token,
+		channel_binding: channel_binding,
+	}, nil
+}
+
+func (ht *htMechanism) Name() string {
+	return ht.name
+}
+
+func (ht *htMechanism) hash(direction string) []byte {
+	mac := hmac.New(sha256.New, []byte(ht.token.Token))
+	mac.Write([]byte(direction))
+	mac.Write(ht.channel_binding)
+	return mac.Sum(nil)
+}
+
+func (ht *htMechanism) Start() ([]byte, error) {
+	return append([]byte(ht.username+"\x00"), ht.hash("Initiator")...), nil
+}
+
+// The success carries the hash of the server, proving it knows the token
+func (ht *htMechanism) Next(challenge []byte) ([]byte, error) {
+	if ht.verified || subtle.ConstantTimeCompare(challenge, ht.hash("Responder")) != 1 {
+		return nil, errors.New("FAST server hash mismatch")
+	}
+	ht.verified = true
+	return nil, nil
+}
+
+// The FAST feature when offered and configured
+func (xmpp *XMPPConnection) fastFeature() *fastFeature {
+	config := xmpp.config.Fast
+	if config == nil || config.Store == nil || xmpp.features == nil || xmpp.features.Authentication == nil {
+		return nil
+	}
+	inline := xmpp.features.Authentication.Inline
+	if inline == nil || inline.Fast == nil {
+		return nil
+	}
+	if xmpp.config.UserAgent == nil || xmpp.config.UserAgent.ID == "" {
+		xmpp.log.Warn("[XEP 0484] FAST requires a user agent ID")
+		return nil
+	}
+	return inline.Fast
+}
+
+// Mechanism logging in with the stored token, nil to use the password
+func (xmpp *XMPPConnection) fastMechanism(credentials *Credentials) Mechanism {
+	feature := xmpp.fastFeature()
+	if feature == nil {
+		return nil
+	}
+	store := xmpp.config.Fast.Store
+	token, err := store.Load()
+	if err != nil {
+		xmpp.log.WithField("error", err).Warn("[XEP 0484] Can not load token")
+		return nil
+	}
+	if token == nil {
+		return nil
+	}
+	if !token.Expiry.IsZero() && time.Now().After(token.Expiry) {
+		xmpp.log.WithField("expiry", token.Expiry).Info("[XEP 0484] Token expired")
+		store.Save(nil)
+		return nil
+	}
+
+	offered := false
+	for _, mechanism := range feature.Mechanism {
+		if mechanism == token.Mechanism {
+			offered = true
+		}
+	}
+	if !offered || !xmpp.allowMechanism(token.Mechanism, credentials) {
+		return nil
+	}
+	ht, err := newHT(token.Mechanism, credentials, token)
+	if err != nil {
+		xmpp.log.WithFields(logrus.Fields{
+			"mechanism": token.Mechanism,
+			"error":     err,
+		}).Warn("[XEP 0484] Token unusable")
+		return nil
+	}
+	return ht
+}
+
+// Add the FAST elements to the authenticate request
+func (xmpp *XMPPConnection) fastRequest(authenticate *sasl2Authenticate, mechanism Mechanism, credentials *Credentials) {
+	feature := xmpp.fastFeature()
+	if feature == nil {
+		return
+	}
+
+	if ht, ok := mechanism.(*htMechanism); ok {
+		// Count the login before trying it, a replay is always refused
+		ht.token.Count += 1
+		if err := xmpp.config.Fast.Store.Save(ht.token); err != nil {
+			xmpp.log.WithField("error", err).Warn("[XEP 0484] Can not save token")
+		}
+		authenticate.Fast = &fastAuthenticate{
+			Count:      ht.token.Count,
+			Invalidate: xmpp.config.Fast.Invalidate,
+		}
+		return
+	}
+	if xmpp.config.Fast.Invalidate {
+		return
+	}
+
+	// Ask for a token usable with the strongest channel binding
+	for _, name := range fastMechanisms {
+		for _, offered := range feature.Mechanism {
+			if name != offered || !xmpp.allowMechanism(name, credentials) {
+				continue
+			}
+			if _, err := newHT(name, credentials, nil); err == nil {
+				authenticate.RequestToken = &fastRequestToken{Mechanism: name}
+				return
+			}
+		}
+	}
+}
+
+// Keep the token issued or rotated with the success
+func (xmpp *XMPPConnection) fastSuccess(authenticate *sasl2Authenticate, token *fastToken) {
+	if xmpp.config.Fast == nil || xmpp.config.Fast.Store == nil {
+		return
+	}
+	store := xmpp.config.Fast.Store
+
+	if authenticate.Fast != nil && authenticate.Fast.Invalidate {
+		xmpp.log.Info("[XEP 0484] Token invalidated")
+		store.Save(nil)
+		return
+	}
+	if token == nil {
+		return
+	}
+
+	// The token belongs to the requested mechanism, or to the HT mechanism
+	// it rotates. Anything else could never be used for FAST.
+	var mechanism string
+	switch {
+	case authenticate.RequestToken != nil:
+		mechanism = authenticate.RequestToken.Mechanism
+	case authenticate.Fast != nil:
+		mechanism = authenticate.Mechanism
+	default:
+		xmpp.log.WithField("mechanism", authenticate.Mechanism).Warn("[XEP 0484] Ignoring token not requested")
+		return
+	}
+	expiry, err := time.Parse(time.RFC3339, token.Expiry)
+	if err != nil {
+		expiry = time.Time{}
+	}
+	xmpp.log.WithFields(logrus.Fields{
+		"mechanism": mechanism,
+		"expiry":    expiry,
+	}).Info("[XEP 0484] Token received")
+	err = store.Save(&FastToken{
+		Mechanism: mechanism,
+		Token:     token.Token,
+		Expiry:    expiry,
+	})
+	if err != nil {
+		xmpp.log.WithField("error", err).Warn("[XEP 0484] Can not save token")
+	}
+}
+
+// The server refused the token, forget it
+func (xmpp *XMPPConnection) fastRefused() {
+	xmpp.log.Info("[XEP 0484] Token refused")
+	xmpp.config.Fast.Store.Save(nil)
+}
@@ -0,0 +1,269 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFastSuccess(t *testing.T) {
+	previous := &FastToken{Mechanism: "HT-SHA-256-ENDP", Token: "old", Count: 3}
+	for _, test := range []struct {
+		name         string
+		authenticate sasl2Authenticate
+		token        *fastToken
+		// Mechanism of the stored token, empty when none is stored
+		want string
+	}{
+		{
+			name: "requested",
+			authenticate: sasl2Authenticate{
+				Mechanism:    "SCRAM-SHA-256",
+				RequestToken: &fastRequestToken{Mechanism: "HT-SHA-256-EXPR"},
+			},
+			token: &fastToken{Token: "new", Expiry: "2030-01-01T00:00:00Z"},
+			want:  "HT-SHA-256-EXPR",
+		},
+		{
+			name: "rotated",
+			authenticate: sasl2Authenticate{
+				Mechanism: "HT-SHA-256-ENDP",
+				Fast:      &fastAuthenticate{Count: 4},
+			},
+			token: &fastToken{Token: "new"},
+			want:  "HT-SHA-256-ENDP",
+		},
+		{
+			name:         "not requested",
+			authenticate: sasl2Authenticate{Mechanism: "PLAIN"},
+			token:        &fastToken{Token: "new"},
+			want:         "HT-SHA-256-ENDP",
+		},
+		{
+			name: "invalidated",
+			authenticate: sasl2Authenticate{
+				Mechanism: "HT-SHA-256-ENDP",
+				Fast:      &fastAuthenticate{Count: 4, Invalidate: true},
+			},
+			token: &fastToken{Token: "new"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryTokenStore()
+			store.Save(previous)
+			xmpp := &XMPPConnection{
+				config: ClientConfig{Fast: &FastConfig{Store: store}},
+				log:    logrus.New(),
+			}
+			xmpp.fastSuccess(&test.authenticate, test.token)
+
+			token, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case test.want == "" && token != nil:
+				t.Errorf("token %+v kept", token)
+			case test.want != "" && token == nil:
+				t.Errorf("no token, want one for %s", test.want)
+			case token != nil && token.Mechanism != test.want:
+				t.Errorf("token for %s, want %s", token.Mechanism, test.want)
+			}
+		})
+	}
+}
+
+func TestFastMechanismPolicy(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		policy MechanismPolicy
+		used   bool
+	}{
+		{"no policy", nil, true},
+		{"allowed", func(mechanism string, state *tls.ConnectionState) bool { return mechanism != "PLAIN" }, true},
+		{"refused", func(mechanism string, state *tls.ConnectionState) bool { return mechanism != "HT-SHA-256-NONE" }, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryTokenStore()
+			store.Save(&FastToken{Mechanism: "HT-SHA-256-NONE", Token: "secret"})
+			xmpp := &XMPPConnection{
+				config: ClientConfig{
+					Fast:            &FastConfig{Store: store},
+					UserAgent:       &UserAgent{ID: "d4565fa7-4d72-4749-b3d3-740edbf87770"},
+					MechanismPolicy: test.policy,
+				},
+				features: &streamFeatures{Authentication: &sasl2Authentication{
+					Mechanism: []string{"SCRAM-SHA-256"},
+					Inline: &sasl2Inline{Fast: &fastFeature{
+						Mechanism: []string{"HT-SHA-256-NONE"},
+					}},
+				}},
+				log: logrus.New(),
+			}
+			credentials := &Credentials{Account: "user@example.org", TLS: &tls.ConnectionState{}}
+
+			mechanism := xmpp.fastMechanism(credentials)
+			if used := mechanism != nil; used != test.used {
+				t.Errorf("token used = %v, want %v", used, test.used)
+			}
+			// No token is requested for a refused mechanism either
+			authenticate := &sasl2Authenticate{Mechanism: "SCRAM-SHA-256"}
+			xmpp.fastRequest(authenticate, nil, credentials)
+			if requested := authenticate.RequestToken != nil; requested != test.used {
+				t.Errorf("token requested = %v, want %v", requested, test.used)
+			}
+		})
+	}
+}
+
+func testHTHash(token string, direction string, channel_binding []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(direction))
+	mac.Write(channel_binding)
+	return mac.Sum(nil)
+}
+
+func TestHTMechanism(t *testing.T) {
+	certificate := &x509.Certificate{Raw: []byte("certificate"), SignatureAlgorithm: x509.ECDSAWithSHA256}
+	state := &tls.ConnectionState{Version: tls.VersionTLS12, PeerCertificates: []*x509.Certificate{certificate}}
+	end_point := sha256.Sum256(certificate.Raw)
+
+	for _, test := range []struct {
+		name            string
+		mechanism       string
+		state           *tls.ConnectionState
+		channel_binding []byte
+	}{
+		{"no channel binding", "HT-SHA-256-NONE", nil, nil},
+		{"server end point", "HT-SHA-256-ENDP", state, end_point[:]},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			token := &FastToken{Mechanism: test.mechanism, Token: "s3cr3t"}
+			credentials := &Credentials{Account: "user@example.org", TLS: test.state}
+			ht, err := newHT(test.mechanism, credentials, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			initial, err := ht.Start()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append([]byte("user\x00"), testHTHash("s3cr3t", "Initiator", test.channel_binding)...)
+			if !hmac.Equal(initial, want) {
+				t.Errorf("initial response = %x, want %x", initial, want)
+			}
+
+			if _, err := ht.Next(testHTHash("s3cr3t", "Initiator", test.channel_binding)); err == nil {
+				t.Error("initiator hash accepted from the server")
+			}
+			if _, err := ht.Next(testHTHash("other", "Responder", test.channel_binding)); err == nil {
+				t.Error("hash of another token accepted")
+			}
+			responder := testHTHash("s3cr3t", "Responder", test.channel_binding)
+			if _, err := ht.Next(responder); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ht.Next(responder); err == nil {
+				t.Error("replayed server hash accepted")
+			}
+		})
+	}
+
+	// The channel binding must match the TLS session
+	if _, err := newHT("HT-SHA-256-ENDP", &Credentials{Account: "user@example.org"}, &FastToken{}); err == nil {
+		t.Error("HT-SHA-256-ENDP without TLS")
+	}
+	if _, err := newHT("HT-SHA-512-NONE", &Credentials{Account: "user@example.org"}, &FastToken{}); err == nil {
+		t.Error("unsupported HT mechanism")
+	}
+}
+
+// Connection offering SASL 2 with FAST and SCRAM-SHA-256
+func testFastConnection(store TokenStore, answer func(authenticate *sasl2Authenticate) interface{}) *XMPPConnection {
+	xmpp := testConnection(func(data string) interface{} {
+		var authenticate sasl2Authenticate
+		if xml.Unmarshal([]byte(data), &authenticate) != nil {
+			return nil
+		}
+		return answer(&authenticate)
+	})
+	xmpp.config.Fast = &FastConfig{Store: store}
+	xmpp.config.UserAgent = &UserAgent{ID: "d4565fa7-4d72-4749-b3d3-740edbf87770"}
+	xmpp.features = &streamFeatures{Authentication: &sasl2Authentication{
+		Mechanism: []string{"SCRAM-SHA-256"},
+		Inline:    &sasl2Inline{Fast: &fastFeature{Mechanism: []string{"HT-SHA-256-NONE"}}},
+	}}
+	return xmpp
+}
+
+func TestFastTokenExpired(t *testing.T) {
+	store := NewMemoryTokenStore()
+	store.Save(&FastToken{Mechanism: "HT-SHA-256-NONE", Token: "s3cr3t", Expiry: time.Now().Add(-time.Minute)})
+	xmpp := testFastConnection(store, nil)
+	defer close(xmpp.done)
+
+	if mechanism := xmpp.fastMechanism(&Credentials{Account: "user@example.org"}); mechanism != nil {
+		t.Errorf("expired token used with %s", mechanism.Name())
+	}
+	if token, _ := store.Load(); token != nil {
+		t.Errorf("expired token %+v kept", token)
+	}
+}
+
+func TestFastTokenRefused(t *testing.T) {
+	not_authorized := &sasl2Failure{Elements: []Extension{{XMLName: xml.Name{Space: nsSASL, Local: "not-authorized"}}}}
+	for _, test := range []struct {
+		name     string
+		password string
+		// Answer to the token login
+		answer interface{}
+		// Mechanisms of the authenticate elements sent
+		sent []string
+		kept bool
+	}{
+		{"password login", "secret", not_authorized, []string{"HT-SHA-256-NONE", "SCRAM-SHA-256"}, false},
+		{"no password", "", not_authorized, []string{"HT-SHA-256-NONE"}, false},
+		// Not a refusal of the token
+		{"server hash mismatch", "secret", &sasl2Success{AdditionalData: "AAAA"}, []string{"HT-SHA-256-NONE"}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryTokenStore()
+			store.Save(&FastToken{Mechanism: "HT-SHA-256-NONE", Token: "s3cr3t", Count: 1})
+			var sent []string
+			xmpp := testFastConnection(store, func(authenticate *sasl2Authenticate) interface{} {
+				sent = append(sent, authenticate.Mechanism)
+				if authenticate.Fast != nil {
+					return test.answer
+				}
+				return not_authorized
+			})
+			defer close(xmpp.done)
+
+			err := xmpp.AuthenticateUser(context.Background(), "user@example.org", test.password, "example.org")
+			var auth_error *AuthError
+			if !errors.As(err, &auth_error) {
+				t.Fatalf("err = %v, want *AuthError", err)
+			}
+			if !reflect.DeepEqual(sent, test.sent) {
+				t.Errorf("sent %v, want %v", sent, test.sent)
+			}
+			token, _ := store.Load()
+			if kept := token != nil; kept != test.kept {
+				t.Fatalf("token kept = %v, want %v", kept, test.kept)
+			}
+			// The attempt is counted before it is sent
+			if token != nil && token.Count != 2 {
+				t.Errorf("count = %d, want 2", token.Count)
+			}
+		})
+	}
+}
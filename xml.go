@@ -1,24 +1,46 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
 	"errors"
 	"github.com/sirupsen/logrus"
+	"time"
 )
 
 // Read next XML element and send it to ProcessElement function
 func (xmpp *XMPPConnection) NextElement() incomingResult {
-	var nv incomingResult
-	t, _ := xmpp.reader.Token()
+	for {
+		t, err := xmpp.reader.Token()
+		if err != nil {
+			return incomingResult{xml.Name{}, nil, err}
+		}
 
-	switch t := t.(type) {
-	case xml.ProcInst:
-		logrus.Info("Received XML from server")
-		return xmpp.NextElement()
-	case xml.StartElement:
-		nv = xmpp.ProcessElement(t)
+		switch t := t.(type) {
+		case xml.ProcInst:
+			xmpp.log.Info("Received XML from server")
+		case xml.StartElement:
+			return xmpp.ProcessElement(t)
+		}
 	}
-	return nv
+}
+
+// NextElement bounded by the context: the socket deadline interrupts the
+// read once the context is done
+func (xmpp *XMPPConnection) nextElement(ctx context.Context) incomingResult {
+	if err := ctx.Err(); err != nil {
+		return incomingResult{xml.Name{}, nil, err}
+	}
+	stop := context.AfterFunc(ctx, func() {
+		xmpp.conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	result := xmpp.NextElement()
+	if result.Error != nil && ctx.Err() != nil {
+		result.Error = ctx.Err()
+	}
+	return result
 }
 
 // Decode XML element
@@ -43,7 +65,7 @@ func (xmpp *XMPPConnection) ProcessElement(se xml.StartElement) incomingResult {
 				stream.Xmlns = attr.Value
 			}
 		}
-		logrus.WithFields(logrus.Fields{
+		xmpp.log.WithFields(logrus.Fields{
 			"stream":  stream.Stream,
 			"lang":    stream.Lang,
 			"id":      stream.ID,
@@ -55,38 +77,56 @@ func (xmpp *XMPPConnection) ProcessElement(se xml.StartElement) incomingResult {
 		nv = &streamFeatures{}
 	case nsStartTLS + " proceed":
 		nv = &tlsProceed{}
+	case nsStartTLS + " failure":
+		nv = &tlsFailure{}
+	case nsSASL + " challenge":
+		nv = &saslChallenge{}
 	case nsSASL + " success":
 		nv = &saslSuccess{}
 	case nsSASL + " failure":
 		nv = &saslFailure{}
+	case nsSASL2 + " challenge":
+		nv = &sasl2Challenge{}
+	case nsSASL2 + " continue":
+		nv = &sasl2Continue{}
+	case nsSASL2 + " task-data":
+		nv = &sasl2TaskData{}
+	case nsSASL2 + " success":
+		nv = &sasl2Success{}
+	case nsSASL2 + " failure":
+		nv = &sasl2Failure{}
 	case nsClient + " iq":
-		nv = &clientIQ{}
+		nv = &IQ{}
+	case nsClient + " message":
+		nv = &Message{}
+	case nsClient + " presence":
+		nv = &Presence{}
 	case nsStreamMgmt + " enabled":
 		nv = &streamMgmtEnabled{}
+	case nsStreamMgmt + " failed":
+		nv = &streamMgmtFailed{}
 	case nsStreamMgmt + " a":
 		nv = &streamMgmtAnswer{}
 	case nsStreamMgmt + " r":
 		nv = &streamMgmtRequest{}
 	default:
+		// Drop the whole element so its children are not read as stanzas
+		xmpp.reader.Skip()
 		return (incomingResult{xml.Name{}, nil, errors.New("unexpected XMPP message " +
 			se.Name.Space + " " + se.Name.Local)})
 	}
 
-	if xmpp.reader == nil {
-		return incomingResult{xml.Name{}, nil, err}
-	}
-
 	// Unmarshal into that storage.
-	err = xmpp.reader.DecodeElement(nv, &se)
+	err := xmpp.reader.DecodeElement(nv, &se)
 	if err != nil {
 		return incomingResult{xml.Name{}, nil, err}
 	}
 
 	// If stream management is active
-	if xmpp.State.Sm != nil && xmpp.State.Sm.state {
+	if sm := xmpp.sm.Load(); sm != nil {
 		// Do not count namespace stream management
 		if se.Name.Space != nsStreamMgmt {
-			xmpp.State.Sm.handled += 1
+			sm.handled.Add(1)
 		}
 	}
 	return incomingResult{se.Name, nv, err}
@@ -2,9 +2,18 @@ package xmpp
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/xml"
+	"errors"
 	"github.com/sirupsen/logrus"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type incomingResult struct {
@@ -13,123 +22,426 @@ type incomingResult struct {
 	Error     error
 }
 
+// Raw XML queued for the Write goroutine
+type outgoingData struct {
+	data string
+	// Stream management elements are not counted as sent stanzas
+	nonza bool
+}
+
 type XMPPConnection struct {
-	incoming chan incomingResult
-	outgoing chan string
-	reader   *xml.Decoder
-	writer   *bufio.Writer
-	conn     net.Conn
-	State    XMPPState
+	incoming  chan incomingResult
+	outgoing  chan outgoingData
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+	// IQ requests waiting for a response, by id
+	pending     map[string]chan *IQ
+	pendingLock sync.Mutex
+	// Messages left to the Messages channel
+	messages       chan *Message
+	messagesWanted atomic.Bool
+	// Roster pushes left to the RosterEvents channel
+	rosterEvents       chan RosterEvent
+	rosterEventsWanted atomic.Bool
+	// Subscription requests left to the SubscriptionRequests channel
+	subscriptions       chan *Presence
+	subscriptionsWanted atomic.Bool
+	reader              *xml.Decoder
+	writer              *bufio.Writer
+	conn                net.Conn
+	tls                 *tls.Conn
+	config              ClientConfig
+	mux                 *Mux
+	log                 logrus.FieldLogger
+	features            *streamFeatures
+	// Stream management once enabled, read by the Read and Write goroutines
+	sm    atomic.Pointer[StreamManagementConfig]
+	State XMPPState
 }
 
 type XMPPState struct {
 	Jid       string
 	Resource  string
+	Auth      *AuthConfig
+	Carbons   bool // XEP 0280
 	Roster    *RosterConfig
 	Discovery *DiscoveryConfig
 	Sm        *StreamManagementConfig
 	Ping      *PingConfig
 }
 
-var err error
-
 func (xmpp *XMPPConnection) Read() {
 	for {
-		if xmpp.reader != nil {
-			t, _ := xmpp.reader.Token()
-			switch t := t.(type) {
-			case xml.StartElement:
-				xmpp.incoming <- xmpp.ProcessElement(t)
-			}
-		} else {
+		t, err := xmpp.reader.Token()
+		if err != nil {
+			xmpp.shutdown(err)
 			return
 		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			select {
+			case xmpp.incoming <- xmpp.ProcessElement(t):
+			case <-xmpp.done:
+				return
+			}
+		case xml.EndElement:
+			// </stream:stream>
+			if t.Name.Space == nsStream && t.Name.Local == "stream" {
+				xmpp.shutdown(io.EOF)
+				return
+			}
+		}
 	}
 }
 
 func (xmpp *XMPPConnection) Write() {
 	for {
-		xmpp.writer.WriteString(<-xmpp.outgoing)
-		xmpp.writer.Flush()
-		if xmpp.State.Sm != nil && xmpp.State.Sm.state {
-			xmpp.State.Sm.seq += 1
-			xmpp.State.Sm.output <- 1
+		select {
+		case out := <-xmpp.outgoing:
+			xmpp.writer.WriteString(out.data)
+			if err := xmpp.writer.Flush(); err != nil {
+				xmpp.shutdown(err)
+				return
+			}
+			if sm := xmpp.sm.Load(); sm != nil && !out.nonza {
+				sm.seq.Add(1)
+				select {
+				case sm.output <- 1:
+				default:
+				}
+			}
+		case <-xmpp.done:
+			return
 		}
 	}
 }
 
 func (xmpp *XMPPConnection) Process() {
 	for {
-		t := <-xmpp.incoming
+		var t incomingResult
+		select {
+		case t = <-xmpp.incoming:
+		case <-xmpp.done:
+			return
+		}
+
 		switch t := (t.Interface).(type) {
 		case *streamMgmtRequest:
 			if xmpp.State.Sm != nil && xmpp.State.Sm.state {
 				// Stream Management: answer to server request
-				xmpp.State.Sm.input <- 1
+				select {
+				case xmpp.State.Sm.input <- 1:
+				case <-xmpp.done:
+					return
+				}
 			}
 		case *streamMgmtAnswer:
 			if xmpp.State.Sm != nil && xmpp.State.Sm.state {
 				// Stream Management: verify answer from server
-				xmpp.State.Sm.verify <- t.Handled
+				select {
+				case xmpp.State.Sm.verify <- t.Handled:
+				case <-xmpp.done:
+					return
+				}
 			}
-		case *clientIQ:
-			if t.Type == "result" {
-				if t.Query != nil {
-					switch t.Query.XMLName.Space {
-					case nsDiscoInfo:
-						// Discovery results
-						xmpp.State.Discovery.incoming <- t
-					case nsRoster:
-						// Roster results
-						xmpp.State.Roster.incoming <- t
-					}
-				} else if xmpp.State.Ping != nil {
-					// Pong
-					xmpp.State.Ping.incoming <- t.ID
+		case *IQ:
+			switch t.Type {
+			case "result", "error":
+				// Responses nobody waits for anymore are dropped
+				if !xmpp.deliverIQ(t) {
+					xmpp.log.WithFields(logrus.Fields{
+						"id":   t.ID,
+						"from": t.From,
+					}).Debug("Dropping unexpected IQ response")
 				}
+			case "get", "set":
+				xmpp.mux.dispatchIQ(xmpp, t)
+			}
+		case *Message:
+			xmpp.mux.dispatchMessage(xmpp, t)
+		case *Presence:
+			if xmpp.State.Roster != nil {
+				xmpp.State.Roster.trackPresence(t)
+			}
+			if t.Type == "subscribe" {
+				xmpp.handleSubscription(t)
 			}
+			xmpp.mux.dispatchPresence(xmpp, t)
 		}
 	}
 }
 
+// Queue raw XML for the Write goroutine
+func (xmpp *XMPPConnection) send(ctx context.Context, data string) error {
+	select {
+	case xmpp.outgoing <- outgoingData{data: data}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-xmpp.done:
+		return xmpp.closeErr()
+	}
+}
+
+// Wait for the next element handed over by the Read goroutine
+func (xmpp *XMPPConnection) receive(ctx context.Context) (incomingResult, error) {
+	select {
+	case result := <-xmpp.incoming:
+		return result, result.Error
+	case <-ctx.Done():
+		return incomingResult{}, ctx.Err()
+	case <-xmpp.done:
+		return incomingResult{}, xmpp.closeErr()
+	}
+}
+
+// Mux returns the stanza dispatcher of the connection
+func (xmpp *XMPPConnection) Mux() *Mux {
+	return xmpp.mux
+}
+
+// Done is closed once the connection is shut down
+func (xmpp *XMPPConnection) Done() <-chan struct{} {
+	return xmpp.done
+}
+
+// Err returns the reason the connection was shut down
+func (xmpp *XMPPConnection) Err() error {
+	select {
+	case <-xmpp.done:
+		return xmpp.closeErr()
+	default:
+		return nil
+	}
+}
+
+func (xmpp *XMPPConnection) closeErr() error {
+	if xmpp.err != nil {
+		return xmpp.err
+	}
+	return ErrClosed
+}
+
+// Stop every goroutine of the connection and close the socket
+func (xmpp *XMPPConnection) shutdown(err error) {
+	xmpp.closeOnce.Do(func() {
+		xmpp.err = err
+		close(xmpp.done)
+		xmpp.conn.Close()
+		xmpp.log.Info("Disconnected")
+	})
+}
+
 func (xmpp *XMPPConnection) Close() {
-	xmpp.incoming = nil
-	xmpp.outgoing = nil
-	xmpp.reader = nil
-	xmpp.writer = nil
-	xmpp = nil
-	logrus.Info("Disconnected")
+	xmpp.shutdown(ErrClosed)
 }
 
-func Connect(account string, password string, domain string, resource string) *XMPPConnection {
-	LogInit()
-	addr, port, _ := resolv_server(account, domain)
+// Dial connects to the XMPP server, negotiates TLS, authenticates and binds
+// a resource. The context bounds the whole negotiation, including retries.
+func Dial(ctx context.Context, config ClientConfig) (*XMPPConnection, error) {
+	for attempt := 1; ; attempt++ {
+		xmpp, err := dial(ctx, config)
+		if err == nil || config.Retry == nil || !Retryable(err) {
+			return xmpp, err
+		}
+		if config.Retry.Attempts > 0 && attempt >= config.Retry.Attempts {
+			return nil, err
+		}
+
+		delay := config.Retry.delay(attempt)
+		config.logger().WithFields(logrus.Fields{
+			"attempt": attempt,
+			"delay":   delay,
+			"error":   err,
+		}).Warn("Connection failed, retrying")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// One connection attempt, config.Timeout bounds it
+func dial(ctx context.Context, config ClientConfig) (*XMPPConnection, error) {
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+
+	xmpp, stop, err := negotiate(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	fail := func(err error) (*XMPPConnection, error) {
+		xmpp.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	domain := config.domain()
+
+	if err := xmpp.AuthenticateUser(ctx, config.Account, config.Password, domain); err != nil {
+		return fail(err)
+	}
+	if !xmpp.State.Auth.Bound {
+		if _, err := xmpp.Bind(ctx, config.Resource); err != nil {
+			return fail(err)
+		}
+	}
+
+	if xmpp.smEnablePending() {
+		if err := xmpp.StartStreamManagement(ctx, true); err != nil {
+			return fail(err)
+		}
+	}
+
+	if !stop() {
+		return fail(ctx.Err())
+	}
+	xmpp.conn.SetDeadline(time.Time{})
+	go xmpp.Process()
+
+	if config.InitialPresence != nil {
+		if err := xmpp.SendPresence(ctx, *config.InitialPresence); err != nil {
+			return fail(err)
+		}
+	}
+
+	return xmpp, nil
+}
+
+// Connect and negotiate TLS, the stream is then ready for authentication.
+// Reads and writes are interrupted once the context is done, until stop is
+// called.
+func negotiate(ctx context.Context, config ClientConfig) (*XMPPConnection, func() bool, error) {
+	if config.Address != "" {
+		return negotiateAddr(ctx, config, config.Address, config.DirectTLS)
+	}
+	log := config.logger()
+	domain := config.domain()
+	resolver := config.resolver()
+
+	servers, err := resolv_server(ctx, log, resolver, domain, config.TLSPolicy != TLSDisabled)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// RFC 6120 # 3.2.1 — try every server in order, and every address of a
+	// server, until the stream is negotiated
+	var last_err error
+	for _, server := range servers {
+		addrs, err := resolver.LookupHost(ctx, strings.TrimSuffix(server.Host, "."))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			last_err = &ResolveError{Domain: server.Host, Err: err}
+		}
+		for _, addr := range addrs {
+			addr = net.JoinHostPort(addr, strconv.Itoa(int(server.Port)))
+			xmpp, stop, err := negotiateAddr(ctx, config, addr, server.DirectTLS)
+			if err == nil {
+				return xmpp, stop, nil
+			}
+			// Another server does not make an untrusted certificate or a
+			// refused policy acceptable
+			if ctx.Err() != nil || !Retryable(err) {
+				return nil, nil, err
+			}
+			last_err = err
+			log.WithFields(logrus.Fields{
+				"addr":  addr,
+				"error": err,
+			}).Warn("XMPP server failed")
+		}
+	}
+	if last_err == nil {
+		last_err = &ResolveError{Domain: domain, Err: errors.New("no address found")}
+	}
+	return nil, nil, last_err
+}
+
+// Connect to one server address and negotiate TLS
+func negotiateAddr(ctx context.Context, config ClientConfig, addr string, direct_tls bool) (*XMPPConnection, func() bool, error) {
+	log := config.logger()
+	domain := config.domain()
 
 	// TCP Connection
-	conn := connect_server(addr, port)
-	//	defer conn.Close()
+	conn, err := connect_server(ctx, log, addr, config.dialTimeout())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Unblock synchronous reads and writes once the context is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
 
 	xmpp := &XMPPConnection{
-		incoming: make(chan incomingResult),
-		outgoing: make(chan string),
-		reader:   xml.NewDecoder(teeIn{conn}),
-		writer:   bufio.NewWriter(teeOut{conn}),
-		State:    XMPPState{},
+		incoming:      make(chan incomingResult),
+		outgoing:      make(chan outgoingData),
+		done:          make(chan struct{}),
+		pending:       make(map[string]chan *IQ),
+		messages:      make(chan *Message, 64),
+		rosterEvents:  make(chan RosterEvent, 64),
+		subscriptions: make(chan *Presence, 64),
+		reader:        xml.NewDecoder(teeIn{conn, log}),
+		writer:        bufio.NewWriter(teeOut{conn, log}),
+		conn:          conn,
+		config:        config,
+		mux:           config.mux(),
+		log:           log,
+		State:         XMPPState{},
+	}
+	xmpp.mux.handleIQDefault("get", xml.Name{Space: nsPing, Local: "ping"}, handlePing)
+	xmpp.mux.handleIQDefault("get", xml.Name{Space: nsDiscoInfo, Local: "query"}, handleDiscoInfo)
+	xmpp.mux.handleIQDefault("set", xml.Name{Space: nsRoster, Local: "query"}, handleRosterPush)
+	xmpp.mux.handleMessageDefault(xml.Name{}, handleMessage)
+	xmpp.mux.AddFeature(nsDiscoInfo, nsPing)
+	fail := func(err error) (*XMPPConnection, func() bool, error) {
+		stop()
+		xmpp.Close()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, err
 	}
 	go xmpp.Write()
 
-	xmpp.StartStream(domain)
-	xmpp.EncryptConnection(domain, conn)
+	if direct_tls {
+		if err := xmpp.handshake(ctx, domain, conn, true); err != nil {
+			return fail(err)
+		}
+	}
+	if err := xmpp.StartStream(ctx, domain); err != nil {
+		return fail(err)
+	}
+	if !direct_tls {
+		if err := xmpp.EncryptConnection(ctx, domain, conn); err != nil {
+			return fail(err)
+		}
+	}
 
 	go xmpp.Read()
+	return xmpp, stop, nil
+}
 
-	xmpp.AuthenticateUser(account, password, domain)
-	xmpp.Bind(resource)
-
-	if xmpp.State.Sm != nil && xmpp.State.Sm.version == 3 {
-		xmpp.StartStreamManagement(true)
-	}
-	go xmpp.Process()
+func Connect(account string, password string, domain string, resource string) *XMPPConnection {
+	LogInit()
+	xmpp, err := Dial(context.Background(), ClientConfig{
+		Account:  account,
+		Password: password,
+		Domain:   domain,
+		Resource: resource,
+		// Announce ourselves as available
+		InitialPresence: &Presence{},
+	})
+	LogError(err, "Connection failed")
 
 	return xmpp
 }